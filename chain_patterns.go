@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+const (
+	// global patterns match a single chain created once by kube-proxy or
+	// the kubelet. Such chains are checkpointed even if nothing jumps to them.
+	chainPatternGlobal = "global"
+	// prefix patterns match the chains created per service or endpoint.
+	chainPatternPrefix = "prefix"
+	// regex patterns match chain names by regular expression.
+	chainPatternRegex = "regex"
+
+	defaultChainProfile = "v1.6"
+)
+
+// chainPattern matches the names of chains created by kube-proxy.
+type chainPattern struct {
+	kind  string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseChainPattern parses a "<kind>:<value>" chain pattern, e.g.
+// "prefix:KUBE-SVC-" or "regex:^KUBE-SEP-[A-Z0-9]{16}$".
+func parseChainPattern(s string) (chainPattern, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || len(parts[1]) == 0 {
+		return chainPattern{}, fmt.Errorf("invalid chain pattern %q: expected <kind>:<value>", s)
+	}
+
+	p := chainPattern{kind: parts[0], value: parts[1]}
+	switch p.kind {
+	case chainPatternGlobal, chainPatternPrefix:
+	case chainPatternRegex:
+		re, err := regexp.Compile(p.value)
+		if err != nil {
+			return chainPattern{}, fmt.Errorf("invalid chain pattern %q: %v", s, err)
+		}
+		p.re = re
+	default:
+		return chainPattern{}, fmt.Errorf("invalid chain pattern %q: unknown kind %q", s, p.kind)
+	}
+	return p, nil
+}
+
+func (p chainPattern) matches(c utiliptables.Chain) bool {
+	switch p.kind {
+	case chainPatternGlobal:
+		return string(c) == p.value
+	case chainPatternPrefix:
+		return strings.HasPrefix(string(c), p.value)
+	case chainPatternRegex:
+		return p.re.MatchString(string(c))
+	}
+	return false
+}
+
+func (p chainPattern) String() string {
+	return p.kind + ":" + p.value
+}
+
+// chainPatterns is the set of patterns matching the chains created by kube-proxy.
+type chainPatterns []chainPattern
+
+// isKubeChain returns true if the given chain is created by kube-proxy.
+func (ps chainPatterns) isKubeChain(c utiliptables.Chain) bool {
+	for _, p := range ps {
+		if p.matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGlobalChain returns true if the given chain is one of the global chains.
+func (ps chainPatterns) isGlobalChain(c utiliptables.Chain) bool {
+	for _, p := range ps {
+		if p.kind == chainPatternGlobal && p.matches(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseChainPatterns(ss ...string) chainPatterns {
+	var ps chainPatterns
+	for _, s := range ss {
+		p, err := parseChainPattern(s)
+		if err != nil {
+			panic(err)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// chainProfiles are the chain patterns of kube-proxy versions.
+var chainProfiles = map[string]chainPatterns{
+	// https://github.com/kubernetes/kubernetes/blob/20ed2a2744cdb0f790df9f792cdda5727726e102/pkg/proxy/iptables/proxier.go#L1315
+	"v1.6": mustParseChainPatterns(
+		// Chains defined in kube-proxy as global consts
+		"global:KUBE-SERVICES",
+		"global:KUBE-HOSTPORTS",
+		"global:KUBE-NODEPORTS",
+		"global:KUBE-POSTROUTING",
+		"global:KUBE-MARK-MASQ",
+		"global:KUBE-MARK-DROP",
+		// Chain defined in the kubelet in the filter table
+		"global:KUBE-FIREWALL",
+		// Chains/Rules defined in kube-proxy as in line consts
+		"prefix:KUBE-SVC-",
+		"prefix:KUBE-SEP-",
+		"prefix:KUBE-FW-",
+		"prefix:KUBE-XLB-",
+	),
+	// KUBE-XLB- chains were replaced by KUBE-EXT- and KUBE-SVL- chains,
+	// kube-proxy and the kubelet create canary chains to detect flushes.
+	"v1.24": mustParseChainPatterns(
+		"global:KUBE-SERVICES",
+		"global:KUBE-NODEPORTS",
+		"global:KUBE-POSTROUTING",
+		"global:KUBE-MARK-MASQ",
+		"global:KUBE-MARK-DROP",
+		"global:KUBE-PROXY-CANARY",
+		"global:KUBE-KUBELET-CANARY",
+		"global:KUBE-FORWARD",
+		"global:KUBE-FIREWALL",
+		"global:KUBE-EXTERNAL-SERVICES",
+		"prefix:KUBE-SVC-",
+		"prefix:KUBE-SEP-",
+		"prefix:KUBE-FW-",
+		"prefix:KUBE-EXT-",
+		"prefix:KUBE-SVL-",
+	),
+	// KUBE-MARK-DROP is no longer created in the nat table.
+	"v1.28": mustParseChainPatterns(
+		"global:KUBE-SERVICES",
+		"global:KUBE-NODEPORTS",
+		"global:KUBE-POSTROUTING",
+		"global:KUBE-MARK-MASQ",
+		"global:KUBE-PROXY-CANARY",
+		"global:KUBE-KUBELET-CANARY",
+		"global:KUBE-FORWARD",
+		"global:KUBE-FIREWALL",
+		"global:KUBE-EXTERNAL-SERVICES",
+		"global:KUBE-PROXY-FIREWALL",
+		"prefix:KUBE-SVC-",
+		"prefix:KUBE-SEP-",
+		"prefix:KUBE-FW-",
+		"prefix:KUBE-EXT-",
+		"prefix:KUBE-SVL-",
+	),
+}
+
+// loadChainPatterns returns the patterns of the given profile extended by
+// the given comma separated patterns and the patterns in the given file, if
+// any. The file holds one pattern per line, lines starting with # are ignored.
+// The profile "none" has no patterns.
+func loadChainPatterns(profile, patterns, file string) (chainPatterns, error) {
+	var ps chainPatterns
+	if profile != "none" {
+		profilePatterns, ok := chainProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown kube-proxy profile %q", profile)
+		}
+		ps = append(ps, profilePatterns...)
+	}
+
+	for _, s := range strings.Split(patterns, ",") {
+		s = strings.TrimSpace(s)
+		if len(s) == 0 {
+			continue
+		}
+		p, err := parseChainPattern(s)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+
+	if len(file) > 0 {
+		fps, err := readChainPatternsFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, fps...)
+	}
+
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no chain patterns configured")
+	}
+	return ps, nil
+}
+
+// readChainPatternsFile reads the chain patterns in the given file.
+func readChainPatternsFile(file string) (chainPatterns, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ps chainPatterns
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := parseChainPattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps, scanner.Err()
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const checkpointerHosts = "hosts"
+
+// recoveryOrder is the order checkpointers are restored in by -r. The
+// kube-proxy state is restored first, the endpoints rules of kenc take
+// precedence over it for the etcd service ip.
+var recoveryOrder = []string{
+	modeIptablesCheckpoint,
+	modeIPVSCheckpoint,
+	modeEndpointsCheckpoint,
+	checkpointerHosts,
+}
+
+// checkpointer periodically checkpoints a part of the etcd network state and
+// restores it on recovery.
+type checkpointer interface {
+	// setup prepares the checkpointer before checkpoint or restore is called.
+	setup() error
+	// checkpoint saves the checkpoint with the given settings. Failures are
+	// logged.
+	checkpoint(s *reloadableSettings)
+	// restore restores the checkpoint. A missing checkpoint is not an error.
+	restore() error
+	// fallbackRouting returns the routing installed by the fallback mode,
+	// or nil if the checkpointer has nothing to route.
+	fallbackRouting() (fallbackRouting, error)
+}
+
+// newCheckpointer returns the checkpointer of the given name.
+func newCheckpointer(name string) (checkpointer, error) {
+	switch name {
+	case modeEndpointsCheckpoint:
+		return &endpointsModeCheckpointer{}, nil
+	case modeIptablesCheckpoint:
+		return &iptablesModeCheckpointer{}, nil
+	case modeIPVSCheckpoint:
+		return &ipvsModeCheckpointer{}, nil
+	case checkpointerHosts:
+		return &hostsModeCheckpointer{}, nil
+	default:
+		return nil, fmt.Errorf("unknown checkpointer: %v", name)
+	}
+}
+
+// parseCheckpointers parses a comma separated list of checkpointers. If it
+// is empty, the checkpointer of the given mode runs, with the hosts
+// checkpointer if hosts is true. The checkpointers are returned in recovery
+// order.
+func parseCheckpointers(s, mode string, hosts bool) ([]string, error) {
+	if len(strings.TrimSpace(s)) == 0 {
+		s = mode
+		if hosts {
+			s += "," + checkpointerHosts
+		}
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if _, err := newCheckpointer(name); err != nil {
+			return nil, err
+		}
+		enabled[name] = true
+	}
+
+	var names []string
+	for _, name := range recoveryOrder {
+		if enabled[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no checkpointer enabled")
+	}
+	return names, nil
+}
+
+// parseCheckpointIntervals parses a comma separated list of
+// <checkpointer>=<duration> intervals.
+func parseCheckpointIntervals(s string) (map[string]time.Duration, error) {
+	intervals := map[string]time.Duration{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid checkpoint interval %q: expected <checkpointer>=<duration>", item)
+		}
+		if _, err := newCheckpointer(parts[0]); err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint interval %q: %v", item, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid checkpoint interval %q: must be positive", item)
+		}
+		intervals[parts[0]] = d
+	}
+	return intervals, nil
+}
+
+// checkpointerInterval returns the interval of the given checkpointer.
+func checkpointerInterval(name string, intervals map[string]time.Duration) time.Duration {
+	if d, ok := intervals[name]; ok {
+		return d
+	}
+	if name == checkpointerHosts {
+		return hostsInterval
+	}
+	return checkpointInterval
+}
+
+// runCheckpointer takes a checkpoint with the given checkpointer at every
+// interval. The interval is restarted when the settings are reloaded.
+func runCheckpointer(name string, c checkpointer) {
+	for {
+		settingsMu.RLock()
+		interval := checkpointerInterval(name, checkpointerIntervals)
+		reloaded := settingsReloaded
+		settingsMu.RUnlock()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			settingsMu.RLock()
+			s := snapshotSettings()
+			settingsMu.RUnlock()
+			c.checkpoint(s)
+		case <-reloaded:
+			timer.Stop()
+		}
+	}
+}
+
+// endpointsModeCheckpointer checkpoints the etcd endpoints and forwards the
+// etcd service ip to them with the endpoints datapaths. With health checks
+// enabled, only the endpoints that are not ejected are forwarded to.
+type endpointsModeCheckpointer struct {
+	dps    []endpointsDatapath
+	cp     *endpointsCheckpointer
+	health *healthChecker
+
+	// mu serializes the datapath syncs of checkpoints and health checks
+	mu sync.Mutex
+}
+
+func (c *endpointsModeCheckpointer) setup() error {
+	dps, err := newEndpointsDatapaths()
+	if err != nil {
+		return fmt.Errorf("cannot setup endpoints datapath: %v", err)
+	}
+	c.dps = dps
+	return nil
+}
+
+func (c *endpointsModeCheckpointer) checkpoint(s *reloadableSettings) {
+	if c.cp == nil {
+		c.cp = newEndpointCheckpointer(mustNewKubeClient())
+	}
+
+	if c.health == nil && healthCheckInterval > 0 {
+		tlsFiles := utiletcd.TLSFiles{CAFile: etcdCAFile, CertFile: etcdCertFile, KeyFile: etcdKeyFile}
+		probe := newEndpointProber(healthCheckTimeout, healthCheckEtcd, tlsFiles)
+		c.health = newHealthChecker(probe, healthCheckFall, healthCheckRise)
+		go c.runHealthChecks(healthCheckInterval)
+	}
+
+	err := c.cp.checkpoint(s.etcdSelector)
+	if err != nil {
+		log.Printf("failed to checkpoint etcd endpoints: %v", err)
+	}
+
+	// the rotation is computed under the lock, a health check must not sync
+	// the datapaths with endpoints older than these
+	c.mu.Lock()
+	eps := c.cp.endpoints
+	if c.health != nil {
+		c.health.setEndpoints(eps)
+		eps = c.health.rotation()
+	}
+	err = syncEndpoints(c.dps, eps)
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("failed to update datapath rules: %v", err)
+	}
+}
+
+// runHealthChecks probes the checkpointed endpoints at every interval and
+// syncs the datapaths when an endpoint is ejected or readmitted.
+func (c *endpointsModeCheckpointer) runHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if !c.health.check() {
+			continue
+		}
+		c.mu.Lock()
+		err := syncEndpoints(c.dps, c.health.rotation())
+		c.mu.Unlock()
+		if err != nil {
+			log.Printf("failed to update datapath rules: %v", err)
+		}
+	}
+}
+
+func (c *endpointsModeCheckpointer) restore() error {
+	for _, dp := range c.dps {
+		err := dp.ensureRoute()
+		if err != nil {
+			return fmt.Errorf("cannot write route rule for checkpoint: %v", err)
+		}
+	}
+
+	eps, err := getEndpointsFromCheckpoint()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("cannot open endpoints checkpoint file: %v", err)
+	}
+	err = syncEndpoints(c.dps, eps)
+	if err != nil {
+		return fmt.Errorf("cannot setup datapath rules for recovery: %v", err)
+	}
+	return nil
+}
+
+func (c *endpointsModeCheckpointer) fallbackRouting() (fallbackRouting, error) {
+	return &endpointsFallback{dps: c.dps}, nil
+}
+
+// iptablesModeCheckpointer checkpoints the kube-proxy iptables rules.
+type iptablesModeCheckpointer struct{}
+
+func (c *iptablesModeCheckpointer) setup() error {
+	err := ensureLinkingChains(ipt, iptSelection.tables)
+	if err != nil {
+		return fmt.Errorf("failed to ensure iptables chains: %v", err)
+	}
+	if ip6t != nil {
+		err = ensureLinkingChains(ip6t, iptSelection.tables)
+		if err != nil {
+			return fmt.Errorf("failed to ensure ip6tables chains: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *iptablesModeCheckpointer) checkpoint(s *reloadableSettings) {
+	err := saveIPtables(ipt, vip, s.iptSelection, checkpointDir, iptablesCheckpointFile)
+	if err != nil {
+		log.Printf("failed to save iptables: %v", err)
+	}
+	if ip6t != nil {
+		err = saveIPtables(ip6t, vip6, s.iptSelection, checkpointDir, ip6tablesCheckpointFile)
+		if err != nil {
+			log.Printf("failed to save ip6tables: %v", err)
+		}
+	}
+}
+
+func (c *iptablesModeCheckpointer) restore() error {
+	p, err := restoreIPtablesFromFile(ipt, vip, iptSelection.tables, path.Join(checkpointDir, iptablesCheckpointFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to restore iptables: %v", err)
+	}
+	if err == nil {
+		log.Printf("iptables: %s", p)
+	}
+	if ip6t != nil {
+		p, err = restoreIPtablesFromFile(ip6t, vip6, iptSelection.tables, path.Join(checkpointDir, ip6tablesCheckpointFile))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to restore ip6tables: %v", err)
+		}
+		if err == nil {
+			log.Printf("ip6tables: %s", p)
+		}
+	}
+	return nil
+}
+
+func (c *iptablesModeCheckpointer) fallbackRouting() (fallbackRouting, error) {
+	return &iptablesFallback{}, nil
+}
+
+// ipvsModeCheckpointer checkpoints the IPVS virtual servers of the etcd
+// service ips.
+type ipvsModeCheckpointer struct {
+	vips []string
+}
+
+func (c *ipvsModeCheckpointer) setup() error {
+	c.vips = []string{vip}
+	if vip6 != "" {
+		c.vips = append(c.vips, vip6)
+	}
+	return nil
+}
+
+func (c *ipvsModeCheckpointer) checkpoint(s *reloadableSettings) {
+	err := saveIPVS(ipvs, c.vips, checkpointDir, ipvsCheckpointFile)
+	if err != nil {
+		log.Printf("failed to save ipvs: %v", err)
+	}
+}
+
+func (c *ipvsModeCheckpointer) restore() error {
+	err := restoreIPVSFromFile(ipvs, c.vips, path.Join(checkpointDir, ipvsCheckpointFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to restore ipvs: %v", err)
+	}
+	return nil
+}
+
+func (c *ipvsModeCheckpointer) fallbackRouting() (fallbackRouting, error) {
+	return nil, fmt.Errorf("-fallback is not supported by the %s checkpointer", modeIPVSCheckpoint)
+}
+
+// hostsModeCheckpointer checkpoints the host names of the etcd pods. The
+// checkpoint is read by the etcd pods, there is nothing to restore.
+type hostsModeCheckpointer struct {
+	kubecli kubernetes.Interface
+}
+
+func (c *hostsModeCheckpointer) setup() error {
+	return nil
+}
+
+func (c *hostsModeCheckpointer) checkpoint(s *reloadableSettings) {
+	if c.kubecli == nil {
+		// Just don't let it fail if it couldn't new client.
+		// Because we have other checkpointers checkpointing other stuff (e.g. iptables).
+		var err error
+		c.kubecli, err = newKubeClient()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	hosts, err := getEtcdHosts(c.kubecli, etcdSource, s.etcdSelector)
+	if err != nil {
+		log.Printf("failed to checkpoint etcd hosts: %v", err)
+		return
+	}
+	if len(hosts) == 0 {
+		return
+	}
+	if s.hostsManagedBlock {
+		err = saveHostsBlock(s.hostsPath, hosts, s.clusterDomain)
+	} else {
+		err = saveHostsCheckpoint(s.hostsPath, hosts, s.clusterDomain)
+	}
+	if err != nil {
+		log.Printf("failed to update etcd hosts file (%s): %v", s.hostsPath, err)
+	}
+	if s.hostsSRVFile != "" {
+		err = writeFileAtomicMode(path.Dir(s.hostsSRVFile), path.Base(s.hostsSRVFile), getSRVZoneBytes(hosts, s.clusterDomain), 0644)
+		if err != nil {
+			log.Printf("failed to update etcd SRV file (%s): %v", s.hostsSRVFile, err)
+		}
+	}
+}
+
+func (c *hostsModeCheckpointer) restore() error {
+	return nil
+}
+
+func (c *hostsModeCheckpointer) fallbackRouting() (fallbackRouting, error) {
+	return nil, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseCheckpointers(t *testing.T) {
+	tests := []struct {
+		s     string
+		mode  string
+		hosts bool
+		want  []string
+	}{
+		{"", modeIptablesCheckpoint, true, []string{"iptables", "hosts"}},
+		{"", modeEndpointsCheckpoint, true, []string{"endpoints", "hosts"}},
+		{"", modeEndpointsCheckpoint, false, []string{"endpoints"}},
+		{"hosts, endpoints,iptables", modeIPVSCheckpoint, true, []string{"iptables", "endpoints", "hosts"}},
+		{"hosts,iptables", modeIPVSCheckpoint, false, []string{"iptables", "hosts"}},
+		{"endpoints,endpoints", modeIptablesCheckpoint, true, []string{"endpoints"}},
+	}
+	for _, tt := range tests {
+		got, err := parseCheckpointers(tt.s, tt.mode, tt.hosts)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: want %v, got %v", tt.s, tt.want, got)
+		}
+	}
+
+	for _, s := range []string{"iptables,dns", ","} {
+		if _, err := parseCheckpointers(s, modeIptablesCheckpoint, true); err == nil {
+			t.Errorf("expected failure for %q", s)
+		}
+	}
+}
+
+func TestParseCheckpointIntervals(t *testing.T) {
+	intervals, err := parseCheckpointIntervals("iptables=1m, hosts=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := checkpointerInterval("iptables", intervals); d != time.Minute {
+		t.Errorf("got wrong iptables interval %v", d)
+	}
+	if d := checkpointerInterval("hosts", intervals); d != 5*time.Second {
+		t.Errorf("got wrong hosts interval %v", d)
+	}
+	if d := checkpointerInterval("endpoints", intervals); d != checkpointInterval {
+		t.Errorf("got wrong endpoints interval %v", d)
+	}
+	if d := checkpointerInterval("hosts", nil); d != hostsInterval {
+		t.Errorf("got wrong default hosts interval %v", d)
+	}
+
+	for _, s := range []string{"iptables", "dns=1m", "iptables=soon", "iptables=-1s"} {
+		if _, err := parseCheckpointIntervals(s); err == nil {
+			t.Errorf("expected failure for %q", s)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const configVersion = "v1"
+
+// config is the kenc configuration file. Every setting maps to a flag, which
+// overrides the value of the file when given.
+type config struct {
+	Version string `json:"version"`
+
+	Mode                string            `json:"mode,omitempty"`
+	Checkpointers       []string          `json:"checkpointers,omitempty"`
+	CheckpointDir       string            `json:"checkpointDir,omitempty"`
+	CheckpointInterval  string            `json:"checkpointInterval,omitempty"`
+	CheckpointIntervals map[string]string `json:"checkpointIntervals,omitempty"`
+	CheckpointRetention *int              `json:"checkpointRetention,omitempty"`
+	Fallback            *bool             `json:"fallback,omitempty"`
+	EtcdSource          string            `json:"etcdSource,omitempty"`
+	HostsDir            string            `json:"hostsDir,omitempty"`
+	ClusterDomain       string            `json:"clusterDomain,omitempty"`
+
+	Kubeconfig        string `json:"kubeconfig,omitempty"`
+	Master            string `json:"master,omitempty"`
+	KubeletKubeconfig string `json:"kubeletKubeconfig,omitempty"`
+
+	EtcdServiceIP  string `json:"etcdServiceIP,omitempty"`
+	EtcdServiceIP6 string `json:"etcdServiceIP6,omitempty"`
+	EtcdSelector   string `json:"etcdSelector,omitempty"`
+	EtcdNamespace  string `json:"etcdNamespace,omitempty"`
+	EtcdService    string `json:"etcdService,omitempty"`
+	EtcdClientPort *int   `json:"etcdClientPort,omitempty"`
+
+	EtcdTLS etcdTLSConfig `json:"etcdTLS,omitempty"`
+
+	Hosts       hostsConfig       `json:"hosts,omitempty"`
+	DNS         dnsConfig         `json:"dns,omitempty"`
+	Endpoints   endpointsConfig   `json:"endpoints,omitempty"`
+	HealthCheck healthCheckConfig `json:"healthCheck,omitempty"`
+	Iptables    iptablesConfig    `json:"iptables,omitempty"`
+}
+
+type hostsConfig struct {
+	Enabled      *bool  `json:"enabled,omitempty"`
+	File         string `json:"file,omitempty"`
+	ManagedBlock *bool  `json:"managedBlock,omitempty"`
+	SRVFile      string `json:"srvFile,omitempty"`
+	Interval     string `json:"interval,omitempty"`
+}
+
+type etcdTLSConfig struct {
+	CAFile   string `json:"caFile,omitempty"`
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+type dnsConfig struct {
+	Address  string `json:"address,omitempty"`
+	Upstream string `json:"upstream,omitempty"`
+}
+
+type endpointsConfig struct {
+	Datapath string `json:"datapath,omitempty"`
+	IPSet    *bool  `json:"ipset,omitempty"`
+}
+
+type healthCheckConfig struct {
+	Interval string `json:"interval,omitempty"`
+	Timeout  string `json:"timeout,omitempty"`
+	Etcd     *bool  `json:"etcd,omitempty"`
+	Fall     *int   `json:"fall,omitempty"`
+	Rise     *int   `json:"rise,omitempty"`
+}
+
+type iptablesConfig struct {
+	Mode              string   `json:"mode,omitempty"`
+	Tables            []string `json:"tables,omitempty"`
+	Services          []string `json:"services,omitempty"`
+	KubeProxyProfile  string   `json:"kubeProxyProfile,omitempty"`
+	ChainPatterns     []string `json:"chainPatterns,omitempty"`
+	ChainPatternsFile string   `json:"chainPatternsFile,omitempty"`
+}
+
+// configError is an error of the value of a configuration key.
+type configError struct {
+	key string
+	err error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %v", e.key, e.err)
+}
+
+// parseConfig parses and validates the given YAML or JSON configuration.
+func parseConfig(b []byte) (*config, error) {
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	if err = json.Unmarshal(j, &raw); err != nil {
+		return nil, fmt.Errorf("expected a mapping of settings: %v", err)
+	}
+	if err = checkConfigKeys("", raw, reflect.TypeOf(config{})); err != nil {
+		return nil, err
+	}
+
+	c := &config{}
+	if err = json.Unmarshal(j, c); err != nil {
+		if terr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, &configError{key: terr.Field, err: fmt.Errorf("cannot use %s as %v", terr.Value, terr.Type)}
+		}
+		return nil, err
+	}
+
+	if err = c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// checkConfigKeys returns an error for the first key of the given decoded
+// mapping that is not a field of the given struct type.
+func checkConfigKeys(prefix string, raw map[string]interface{}, t reflect.Type) error {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		fields[name] = f.Type
+	}
+
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		ft, ok := fields[k]
+		if !ok {
+			return &configError{key: prefix + k, err: fmt.Errorf("unknown key")}
+		}
+		if sub, ok := raw[k].(map[string]interface{}); ok && ft.Kind() == reflect.Struct {
+			if err := checkConfigKeys(prefix+k+".", sub, ft); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns an error pointing at the first invalid key.
+func (c *config) validate() error {
+	if c.Version != configVersion {
+		return &configError{key: "version", err: fmt.Errorf("unsupported version %q, expected %q", c.Version, configVersion)}
+	}
+
+	if len(c.Mode) > 0 {
+		if _, err := newCheckpointer(c.Mode); err != nil {
+			return &configError{key: "mode", err: err}
+		}
+	}
+	for i, name := range c.Checkpointers {
+		if _, err := newCheckpointer(name); err != nil {
+			return &configError{key: fmt.Sprintf("checkpointers[%d]", i), err: err}
+		}
+	}
+	if len(c.CheckpointInterval) > 0 {
+		if _, err := time.ParseDuration(c.CheckpointInterval); err != nil {
+			return &configError{key: "checkpointInterval", err: err}
+		}
+	}
+	for name, d := range c.CheckpointIntervals {
+		if _, err := parseCheckpointIntervals(name + "=" + d); err != nil {
+			return &configError{key: "checkpointIntervals." + name, err: err}
+		}
+	}
+	if c.CheckpointRetention != nil && *c.CheckpointRetention < 0 {
+		return &configError{key: "checkpointRetention", err: fmt.Errorf("must not be negative")}
+	}
+
+	if len(c.EtcdSelector) > 0 {
+		if _, err := labels.Parse(c.EtcdSelector); err != nil {
+			return &configError{key: "etcdSelector", err: err}
+		}
+	}
+	if c.EtcdClientPort != nil && (*c.EtcdClientPort < 1 || *c.EtcdClientPort > 65535) {
+		return &configError{key: "etcdClientPort", err: fmt.Errorf("port %d out of range", *c.EtcdClientPort)}
+	}
+
+	if len(c.EtcdSource) > 0 {
+		if err := parseEtcdSource(c.EtcdSource); err != nil {
+			return &configError{key: "etcdSource", err: err}
+		}
+	}
+	if (len(c.EtcdTLS.CertFile) > 0) != (len(c.EtcdTLS.KeyFile) > 0) {
+		return &configError{key: "etcdTLS", err: fmt.Errorf("certFile and keyFile must be given together")}
+	}
+	if len(c.Hosts.Interval) > 0 {
+		d, err := time.ParseDuration(c.Hosts.Interval)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			return &configError{key: "hosts.interval", err: err}
+		}
+	}
+
+	if len(c.DNS.Address) > 0 {
+		if _, err := net.ResolveUDPAddr("udp", c.DNS.Address); err != nil {
+			return &configError{key: "dns.address", err: err}
+		}
+	}
+	if len(c.DNS.Upstream) > 0 {
+		if _, _, err := net.SplitHostPort(c.DNS.Upstream); err != nil {
+			return &configError{key: "dns.upstream", err: err}
+		}
+	}
+
+	switch c.Endpoints.Datapath {
+	case "", datapathIptables, datapathNftables:
+	default:
+		return &configError{key: "endpoints.datapath", err: fmt.Errorf("unknown datapath: %v", c.Endpoints.Datapath)}
+	}
+
+	if len(c.HealthCheck.Interval) > 0 {
+		d, err := time.ParseDuration(c.HealthCheck.Interval)
+		if err == nil && d < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err != nil {
+			return &configError{key: "healthCheck.interval", err: err}
+		}
+	}
+	if len(c.HealthCheck.Timeout) > 0 {
+		d, err := time.ParseDuration(c.HealthCheck.Timeout)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err != nil {
+			return &configError{key: "healthCheck.timeout", err: err}
+		}
+	}
+	if c.HealthCheck.Fall != nil && *c.HealthCheck.Fall < 1 {
+		return &configError{key: "healthCheck.fall", err: fmt.Errorf("must be at least 1")}
+	}
+	if c.HealthCheck.Rise != nil && *c.HealthCheck.Rise < 1 {
+		return &configError{key: "healthCheck.rise", err: fmt.Errorf("must be at least 1")}
+	}
+
+	switch c.Iptables.Mode {
+	case "", "auto", "legacy", "nft", "default":
+	default:
+		return &configError{key: "iptables.mode", err: fmt.Errorf("unknown iptables mode: %v", c.Iptables.Mode)}
+	}
+	for i, table := range c.Iptables.Tables {
+		if _, err := parseIptablesTables(table); err != nil {
+			return &configError{key: fmt.Sprintf("iptables.tables[%d]", i), err: err}
+		}
+	}
+	for i, s := range c.Iptables.Services {
+		if strings.Contains(s, ",") {
+			return &configError{key: fmt.Sprintf("iptables.services[%d]", i), err: fmt.Errorf("must not contain ','")}
+		}
+		if _, err := parseServiceSelectors(s); err != nil {
+			return &configError{key: fmt.Sprintf("iptables.services[%d]", i), err: err}
+		}
+	}
+	if len(c.Iptables.KubeProxyProfile) > 0 && c.Iptables.KubeProxyProfile != "none" {
+		if _, ok := chainProfiles[c.Iptables.KubeProxyProfile]; !ok {
+			return &configError{key: "iptables.kubeProxyProfile", err: fmt.Errorf("unknown kube-proxy profile %q", c.Iptables.KubeProxyProfile)}
+		}
+	}
+	for i, p := range c.Iptables.ChainPatterns {
+		// the patterns are passed on as a comma separated flag value, patterns
+		// with a ',' have to go to the chain patterns file
+		if strings.Contains(p, ",") {
+			return &configError{key: fmt.Sprintf("iptables.chainPatterns[%d]", i), err: fmt.Errorf("must not contain ',', use chainPatternsFile")}
+		}
+		if _, err := parseChainPattern(p); err != nil {
+			return &configError{key: fmt.Sprintf("iptables.chainPatterns[%d]", i), err: err}
+		}
+	}
+	return nil
+}
+
+// flagValues returns the flag values of the settings of the configuration.
+func (c *config) flagValues() map[string]string {
+	values := map[string]string{}
+	set := func(name, value string) {
+		if len(value) > 0 {
+			values[name] = value
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			values[name] = strconv.FormatBool(*value)
+		}
+	}
+	setInt := func(name string, value *int) {
+		if value != nil {
+			values[name] = strconv.Itoa(*value)
+		}
+	}
+
+	set("m", c.Mode)
+	set("checkpointers", strings.Join(c.Checkpointers, ","))
+	set("checkpoint-dir", c.CheckpointDir)
+	set("checkpoint-interval", c.CheckpointInterval)
+	var intervals []string
+	for name, d := range c.CheckpointIntervals {
+		intervals = append(intervals, name+"="+d)
+	}
+	sort.Strings(intervals)
+	set("checkpoint-intervals", strings.Join(intervals, ","))
+	setInt("checkpoint-retention", c.CheckpointRetention)
+	setBool("fallback", c.Fallback)
+	set("etcd-source", c.EtcdSource)
+	set("hosts-dir", c.HostsDir)
+	set("cluster-domain", c.ClusterDomain)
+	set("kubeconfig", c.Kubeconfig)
+	set("master", c.Master)
+	set("kubelet-kubeconfig", c.KubeletKubeconfig)
+	set("etcd-service-ip", c.EtcdServiceIP)
+	set("etcd-service-ip6", c.EtcdServiceIP6)
+	set("etcd-selector", c.EtcdSelector)
+	set("etcd-namespace", c.EtcdNamespace)
+	set("etcd-service", c.EtcdService)
+	setInt("etcd-client-port", c.EtcdClientPort)
+	set("etcd-ca-file", c.EtcdTLS.CAFile)
+	set("etcd-cert-file", c.EtcdTLS.CertFile)
+	set("etcd-key-file", c.EtcdTLS.KeyFile)
+
+	setBool("hosts", c.Hosts.Enabled)
+	set("hosts-file", c.Hosts.File)
+	setBool("hosts-managed-block", c.Hosts.ManagedBlock)
+	set("hosts-srv-file", c.Hosts.SRVFile)
+	set("hosts-interval", c.Hosts.Interval)
+
+	set("dns-addr", c.DNS.Address)
+	set("dns-upstream", c.DNS.Upstream)
+
+	set("datapath", c.Endpoints.Datapath)
+	setBool("endpoints-ipset", c.Endpoints.IPSet)
+
+	set("health-check-interval", c.HealthCheck.Interval)
+	set("health-check-timeout", c.HealthCheck.Timeout)
+	setBool("health-check-etcd", c.HealthCheck.Etcd)
+	setInt("health-check-fall", c.HealthCheck.Fall)
+	setInt("health-check-rise", c.HealthCheck.Rise)
+
+	set("iptables-mode", c.Iptables.Mode)
+	set("iptables-tables", strings.Join(c.Iptables.Tables, ","))
+	set("iptables-services", strings.Join(c.Iptables.Services, ","))
+	set("kube-proxy-profile", c.Iptables.KubeProxyProfile)
+	set("iptables-chain-patterns", strings.Join(c.Iptables.ChainPatterns, ","))
+	set("iptables-chain-patterns-file", c.Iptables.ChainPatternsFile)
+	return values
+}
+
+// loadConfigFile sets the flags from the given configuration file, except
+// the flags given on the command line. Settings without a flag in the given
+// set are ignored.
+func loadConfigFile(fs *flag.FlagSet, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for name, value := range c.flagValues() {
+		if given[name] || fs.Lookup(name) == nil {
+			continue
+		}
+		if err = fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: -%s: %v", file, name, err)
+		}
+	}
+	return nil
+}
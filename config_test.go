@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	c, err := parseConfig([]byte(`version: v1
+checkpointers: [iptables, hosts]
+checkpointInterval: 1m
+checkpointIntervals:
+  hosts: 10s
+checkpointRetention: 3
+fallback: true
+clusterDomain: example.org
+hosts:
+  enabled: false
+  file: /etc/kenc/etcd-hosts
+etcdServiceIP: 10.3.0.15
+etcdSelector: component=etcd
+etcdNamespace: etcd
+etcdClientPort: 12379
+iptables:
+  tables: [nat, filter]
+  services:
+  - kube-system/kube-etcd:client
+  kubeProxyProfile: v1.28
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"checkpointers":        "iptables,hosts",
+		"checkpoint-interval":  "1m",
+		"checkpoint-intervals": "hosts=10s",
+		"checkpoint-retention": "3",
+		"fallback":             "true",
+		"cluster-domain":       "example.org",
+		"hosts":                "false",
+		"hosts-file":           "/etc/kenc/etcd-hosts",
+		"etcd-service-ip":      "10.3.0.15",
+		"etcd-selector":        "component=etcd",
+		"etcd-namespace":       "etcd",
+		"etcd-client-port":     "12379",
+		"iptables-tables":      "nat,filter",
+		"iptables-services":    "kube-system/kube-etcd:client",
+		"kube-proxy-profile":   "v1.28",
+	}
+	got := c.flagValues()
+	if len(got) != len(want) {
+		t.Errorf("got wrong flag values: %v", got)
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("got wrong value for -%s: want %q, got %q", name, value, got[name])
+		}
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		key    string
+	}{
+		{`checkpointDir: /tmp`, "version"},
+		{`version: v2`, "version"},
+		{"version: v1\ncheckpointDirectory: /tmp", "checkpointDirectory"},
+		{"version: v1\niptables:\n  tabels: [nat]", "iptables.tabels"},
+		{"version: v1\niptables:\n  tables: [nat, raw]", "iptables.tables[1]"},
+		{"version: v1\ncheckpointIntervals:\n  iptables: soon", "checkpointIntervals.iptables"},
+		{"version: v1\ncheckpointers: [iptables, dns]", "checkpointers[1]"},
+		{"version: v1\nendpoints:\n  ipset: maybe", "endpoints.ipset"},
+		{"version: v1\nendpoints:\n  datapath: ebpf", "endpoints.datapath"},
+		{"version: v1\ncheckpointRetention: -1", "checkpointRetention"},
+		{"version: v1\netcdSelector: app in (etcd", "etcdSelector"},
+		{"version: v1\netcdClientPort: 0", "etcdClientPort"},
+		{"version: v1\nhosts:\n  interval: 0s", "hosts.interval"},
+		{"version: v1\nhealthCheck:\n  fall: 0", "healthCheck.fall"},
+		{"version: v1\nhealthCheck:\n  timeout: 0s", "healthCheck.timeout"},
+		{"version: v1\netcdTLS:\n  keyFile: /etc/kenc/etcd-client.key", "etcdTLS"},
+		{"version: v1\niptables:\n  chainPatterns: [suffix:-CANARY]", "iptables.chainPatterns[0]"},
+		{"version: v1\niptables:\n  chainPatterns: [prefix:KUBE-FW-, 'regex:^KUBE-SEP-[A-Z0-9]{1,16}$']", "iptables.chainPatterns[1]"},
+		{"version: v1\niptables:\n  services: ['kube-system/kube-etcd,kube-system/kube-dns']", "iptables.services[0]"},
+	}
+	for _, tt := range tests {
+		_, err := parseConfig([]byte(tt.config))
+		if err == nil {
+			t.Errorf("expected failure for %q", tt.config)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), tt.key+": ") {
+			t.Errorf("expected error at %s, got %v", tt.key, err)
+		}
+	}
+}
+
+func TestLoadConfigFileFlagsOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "kenc.yaml")
+	err = ioutil.WriteFile(file, []byte("version: v1\ncheckpointDir: /var/lib/kenc\ncheckpointInterval: 1m\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("kenc", flag.ContinueOnError)
+	dirFlag := fs.String("checkpoint-dir", defaultCheckpointDir, "")
+	intervalFlag := fs.Duration("checkpoint-interval", defaultClusterInteval, "")
+	if err = fs.Parse([]string{"-checkpoint-interval", "5s"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = loadConfigFile(fs, file); err != nil {
+		t.Fatal(err)
+	}
+	if *dirFlag != "/var/lib/kenc" {
+		t.Errorf("got wrong checkpoint dir %s", *dirFlag)
+	}
+	if *intervalFlag != 5*time.Second {
+		t.Errorf("expected the flag to override the config file, got %v", *intervalFlag)
+	}
+}
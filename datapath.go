@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	utilipset "github.com/coreos/kenc/pkg/util/ipset"
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+	utilnftables "github.com/coreos/kenc/pkg/util/nftables"
+)
+
+const (
+	datapathIptables = "iptables"
+	datapathNftables = "nftables"
+)
+
+// endpointsDatapath programs the forwarding of the etcd service ip to the
+// checkpointed etcd endpoints of a single address family.
+// This is used to implement etcd endpoints level checkpoint.
+type endpointsDatapath interface {
+	// ensureRoute ensures the traffic sent to the service ip is handled
+	// by the datapath.
+	ensureRoute() error
+	// removeRoute removes the handling of the traffic sent to the service
+	// ip and the endpoints rules.
+	removeRoute() error
+	// syncEndpoints forwards the traffic sent to the service ip to one
+	// of the given endpoints randomly.
+	syncEndpoints(endpoints []string) error
+	// isIPv6 returns true if the datapath handles IPv6 traffic.
+	isIPv6() bool
+}
+
+// newEndpointsDatapath returns the endpoints datapath of the given kind for
+// the given service ip.
+func newEndpointsDatapath(kind string, ipv6 bool, vip string) (endpointsDatapath, error) {
+	switch kind {
+	case datapathIptables:
+		ipt := ipt
+		if ipv6 {
+			ipt = ip6t
+		}
+		dp := &iptablesDatapath{ipt: ipt, vip: vip}
+		if endpointsIPSet {
+			dp.ipset = ipset
+		}
+		return dp, nil
+	case datapathNftables:
+		family := utilnftables.FamilyIPv4
+		if ipv6 {
+			family = utilnftables.FamilyIPv6
+		}
+		return &nftablesDatapath{nft: nft, family: family, vip: vip}, nil
+	default:
+		return nil, fmt.Errorf("unknown datapath: %v", kind)
+	}
+}
+
+// iptablesDatapath implements endpointsDatapath with the SELF-HOSTED-ETCD
+// chain of the NAT table. If ipset is set, the endpoints are kept in an
+// ipset and the chain is only rewritten when the members of the set change
+// or the live chain does not forward to them.
+type iptablesDatapath struct {
+	ipt   utiliptables.Interface
+	ipset utilipset.Interface
+	vip   string
+}
+
+func (d *iptablesDatapath) ensureRoute() error {
+	return writeRouteRule(d.ipt, d.vip)
+}
+
+func (d *iptablesDatapath) removeRoute() error {
+	return deleteRouteRule(d.ipt, d.vip)
+}
+
+func (d *iptablesDatapath) syncEndpoints(endpoints []string) error {
+	if d.ipset == nil {
+		return writeNatTableRule(d.ipt, d.vip, endpoints)
+	}
+	_, err := writeNatTableRuleFromSet(d.ipt, d.ipset, endpoints)
+	return err
+}
+
+func (d *iptablesDatapath) isIPv6() bool {
+	return d.ipt.IsIpv6()
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	utildns "github.com/coreos/kenc/pkg/util/dns"
+)
+
+const (
+	// the ttl of the answers, short as the checkpoint may change any time
+	dnsTTL = 5
+	// the weight of the SRV records, all members are equal
+	dnsSRVWeight = 10
+	// the timeout of forwarded queries
+	dnsForwardTimeout = 2 * time.Second
+)
+
+// dnsCheckpoint is the hosts checkpoint served by the DNS server.
+type dnsCheckpoint struct {
+	hostsFile    string
+	managedBlock bool
+	// the SRV zone file fragment, if any
+	srvFile string
+	domain  string
+}
+
+// dnsRecords are the DNS records of the etcd members of a hosts checkpoint.
+type dnsRecords struct {
+	// the addresses of the names, with a trailing dot
+	ips map[string][]net.IP
+	// the SRV targets of the names, with a trailing dot
+	srvs map[string][]dnsSRV
+	// the zone of the etcd service, with a trailing dot
+	zone string
+}
+
+type dnsSRV struct {
+	port   uint16
+	target string
+}
+
+// newDNSRecords returns the records of the given hosts checkpoint and SRV
+// zone file fragment. Every name of a hosts line resolves to its address.
+// The etcd service name resolves to all members. The etcd SRV services are
+// those of the fragment if it has any, else they point to the fully
+// qualified names of the members on the default ports.
+func newDNSRecords(b []byte, managedBlock bool, srvZone []byte, domain string) *dnsRecords {
+	svcNames := serviceNames(domain)
+	svc := strings.ToLower(svcNames[0])
+	rs := &dnsRecords{
+		ips:  map[string][]net.IP{},
+		srvs: map[string][]dnsSRV{},
+		zone: svc + ".",
+	}
+
+	members := map[string]bool{}
+	var targets []string
+	for _, fields := range hostsCheckpointLines(b, managedBlock) {
+		ip := net.ParseIP(fields[0])
+		for _, name := range fields[1:] {
+			rs.addIP(name, ip)
+		}
+
+		fqdn := strings.ToLower(fields[1])
+		if !strings.HasSuffix(fqdn, "."+svc) {
+			continue
+		}
+		// the service names are the short forms of the member names
+		for _, name := range svcNames {
+			rs.addIP(name, ip)
+		}
+		if !members[fqdn] {
+			members[fqdn] = true
+			targets = append(targets, fqdn+".")
+		}
+	}
+
+	defaults := &hostInfo{PeerPort: defaultPeerPort, ClientPort: etcdClientPort}
+	for _, service := range etcdSRVServices {
+		for _, target := range targets {
+			name := service + "." + rs.zone
+			rs.srvs[name] = append(rs.srvs[name], dnsSRV{port: uint16(defaults.port(service)), target: target})
+		}
+	}
+
+	if srvs := parseSRVZone(srvZone, rs); len(srvs) > 0 {
+		rs.srvs = srvs
+	}
+	return rs
+}
+
+// parseSRVZone returns the SRV records of the given zone file fragment, as
+// written by getSRVZoneBytes, and adds its address records to rs.
+func parseSRVZone(b []byte, rs *dnsRecords) map[string][]dnsSRV {
+	srvs := map[string][]dnsSRV{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		// <name> <ttl> IN <type> <data>...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || strings.HasPrefix(fields[0], ";") || fields[2] != "IN" {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		switch fields[3] {
+		case "A", "AAAA":
+			if ip := net.ParseIP(fields[4]); ip != nil {
+				rs.addIP(name, ip)
+			}
+		case "SRV":
+			if len(fields) != 8 {
+				continue
+			}
+			port, err := strconv.ParseUint(fields[6], 10, 16)
+			if err != nil {
+				continue
+			}
+			srvs[name] = append(srvs[name], dnsSRV{port: uint16(port), target: fields[7]})
+		}
+	}
+	return srvs
+}
+
+func (rs *dnsRecords) addIP(name string, ip net.IP) {
+	name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	for _, known := range rs.ips[name] {
+		if known.Equal(ip) {
+			return
+		}
+	}
+	rs.ips[name] = append(rs.ips[name], ip)
+}
+
+// answer returns the response to the given query, or nil if the name is not
+// known and not in the zone of the etcd service.
+func (rs *dnsRecords) answer(q *utildns.Message) *utildns.Message {
+	if len(q.Questions) != 1 {
+		return q.Reply(utildns.RcodeFormatError)
+	}
+	question := q.Questions[0]
+	name := strings.ToLower(question.Name)
+
+	ips, hasIPs := rs.ips[name]
+	srvs, hasSRVs := rs.srvs[name]
+	if !hasIPs && !hasSRVs {
+		if name == rs.zone || strings.HasSuffix(name, "."+rs.zone) {
+			r := q.Reply(utildns.RcodeNameError)
+			r.Authoritative = true
+			return r
+		}
+		return nil
+	}
+
+	r := q.Reply(utildns.RcodeSuccess)
+	r.Authoritative = true
+	if question.Class != utildns.ClassINET {
+		return r
+	}
+	for _, ip := range ips {
+		isV4 := ip.To4() != nil
+		switch {
+		case isV4 && (question.Type == utildns.TypeA || question.Type == utildns.TypeANY):
+			r.Answers = append(r.Answers, utildns.NewA(question.Name, ip, dnsTTL))
+		case !isV4 && (question.Type == utildns.TypeAAAA || question.Type == utildns.TypeANY):
+			r.Answers = append(r.Answers, utildns.NewAAAA(question.Name, ip, dnsTTL))
+		}
+	}
+	if question.Type == utildns.TypeSRV || question.Type == utildns.TypeANY {
+		for _, srv := range srvs {
+			a, err := utildns.NewSRV(question.Name, 0, dnsSRVWeight, srv.port, srv.target, dnsTTL)
+			if err != nil {
+				continue
+			}
+			r.Answers = append(r.Answers, a)
+		}
+	}
+	return r
+}
+
+// dnsServer answers the queries for the etcd names from the hosts
+// checkpoint. Other queries are forwarded to upstream, or refused if it is
+// empty.
+type dnsServer struct {
+	conn     net.PacketConn
+	upstream string
+	// checkpoint returns the current hosts checkpoint
+	checkpoint func() dnsCheckpoint
+
+	mu      sync.Mutex
+	records *dnsRecords
+	key     string
+}
+
+// newDNSServer returns a DNS server listening on the given UDP address.
+func newDNSServer(addr, upstream string, checkpoint func() dnsCheckpoint) (*dnsServer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsServer{conn: conn, upstream: upstream, checkpoint: checkpoint}, nil
+}
+
+// serve answers queries until the connection is closed.
+func (s *dnsServer) serve() error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go s.handle(query, addr)
+	}
+}
+
+func (s *dnsServer) handle(query []byte, addr net.Addr) {
+	b, err := s.response(query)
+	if err != nil {
+		log.Printf("dns: failed to answer %s: %v", addr, err)
+		return
+	}
+	if b == nil {
+		return
+	}
+	if _, err = s.conn.WriteTo(b, addr); err != nil {
+		log.Printf("dns: failed to reply to %s: %v", addr, err)
+	}
+}
+
+// response returns the response to the given query, or nil if it is not
+// answered.
+func (s *dnsServer) response(query []byte) ([]byte, error) {
+	q, err := utildns.Parse(query)
+	if err != nil || q.Response {
+		// not a query, drop it
+		return nil, nil
+	}
+	if q.Opcode != 0 {
+		return q.Reply(utildns.RcodeNotImplemented).PackUDP()
+	}
+
+	if r := s.getRecords().answer(q); r != nil {
+		return r.PackUDP()
+	}
+	if len(s.upstream) == 0 {
+		return q.Reply(utildns.RcodeRefused).PackUDP()
+	}
+	b, err := forwardDNS(s.upstream, query)
+	if err != nil {
+		log.Printf("dns: failed to forward query: %v", err)
+		return q.Reply(utildns.RcodeServerFailure).PackUDP()
+	}
+	return b, nil
+}
+
+// getRecords returns the records of the current hosts checkpoint, which is
+// re-read when it changes.
+func (s *dnsServer) getRecords() *dnsRecords {
+	cp := s.checkpoint()
+	key := fmt.Sprintf("%+v", cp)
+	for _, file := range []string{cp.hostsFile, cp.srvFile} {
+		if fi, err := os.Stat(file); err == nil {
+			key += ":" + fi.ModTime().String() + ":" + strconv.FormatInt(fi.Size(), 10)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.records != nil && s.key == key {
+		return s.records
+	}
+	b, err := ioutil.ReadFile(cp.hostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("dns: failed to read hosts checkpoint: %v", err)
+	}
+	var srvZone []byte
+	if len(cp.srvFile) > 0 {
+		srvZone, err = ioutil.ReadFile(cp.srvFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("dns: failed to read SRV checkpoint: %v", err)
+		}
+	}
+	s.records = newDNSRecords(b, cp.managedBlock, srvZone, cp.domain)
+	s.key = key
+	return s.records
+}
+
+// forwardDNS sends the given query to the given upstream server and returns
+// its response.
+func forwardDNS(upstream string, query []byte) ([]byte, error) {
+	conn, err := net.Dial("udp", upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(dnsForwardTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// hostsCheckpoint returns the current hosts checkpoint settings.
+func hostsCheckpoint() dnsCheckpoint {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return dnsCheckpoint{
+		hostsFile:    hostsPath,
+		managedBlock: hostsManagedBlock,
+		srvFile:      hostsSRVFile,
+		domain:       clusterDomain,
+	}
+}
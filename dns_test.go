@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	utildns "github.com/coreos/kenc/pkg/util/dns"
+)
+
+// startDNSServer serves the given hosts checkpoint on a local UDP port.
+func startDNSServer(t *testing.T, cp dnsCheckpoint, upstream string) *dnsServer {
+	cp.domain = defaultClusterDomain
+	s, err := newDNSServer("127.0.0.1:0", upstream, func() dnsCheckpoint {
+		return cp
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.serve()
+	return s
+}
+
+// queryDNS sends a query of the given name and type to the given server.
+func queryDNS(t *testing.T, addr, name string, qtype uint16) (*utildns.Message, []utildns.Resource) {
+	q := &utildns.Message{ID: 42, RecursionDesired: true, Questions: []utildns.Question{{Name: name, Type: qtype, Class: utildns.ClassINET}}}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := utildns.Parse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != q.ID || !m.Response {
+		t.Fatalf("got wrong response header %+v", m)
+	}
+	answers, err := utildns.ParseAnswers(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, answers
+}
+
+func answerData(t *testing.T, answers []utildns.Resource) []string {
+	var data []string
+	for _, a := range answers {
+		switch a.Type {
+		case utildns.TypeA, utildns.TypeAAAA:
+			data = append(data, net.IP(a.Data).String())
+		case utildns.TypeSRV:
+			_, _, port, target, err := utildns.ParseSRV(a.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, net.JoinHostPort(target, strconv.Itoa(int(port))))
+		}
+	}
+	sort.Strings(data)
+	return data
+}
+
+func TestDNSServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, etcdHostsFilename)
+	if err = saveHostsCheckpoint(file, exampleHosts, defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startDNSServer(t, dnsCheckpoint{hostsFile: file}, "")
+	defer s.conn.Close()
+	addr := s.conn.LocalAddr().String()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode uint8
+		want  []string
+	}{
+		{"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA, utildns.RcodeSuccess, []string{"10.2.0.5"}},
+		{"KUBE-ETCD-0000.kube-etcd.", utildns.TypeA, utildns.RcodeSuccess, []string{"10.2.0.5"}},
+		{"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeAAAA, utildns.RcodeSuccess, nil},
+		{"node-1.kube-etcd.kube-system.svc.", utildns.TypeAAAA, utildns.RcodeSuccess, []string{"fd00::101"}},
+		{"kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA, utildns.RcodeSuccess, []string{"10.2.0.5", "172.17.4.101"}},
+		{"_etcd-server._tcp.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeSRV, utildns.RcodeSuccess, []string{
+			"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.:2380",
+			"node-1.kube-etcd.kube-system.svc.cluster.local.:2380",
+		}},
+		{"_etcd-client._tcp.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeSRV, utildns.RcodeSuccess, []string{
+			"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.:2379",
+			"node-1.kube-etcd.kube-system.svc.cluster.local.:2379",
+		}},
+		{"kube-etcd-0009.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA, utildns.RcodeNameError, nil},
+		{"example.com.", utildns.TypeA, utildns.RcodeRefused, nil},
+	}
+	for _, tt := range tests {
+		m, answers := queryDNS(t, addr, tt.name, tt.qtype)
+		if m.Rcode != tt.rcode {
+			t.Errorf("%s: got wrong rcode, want=%d, got=%d", tt.name, tt.rcode, m.Rcode)
+		}
+		if got := answerData(t, answers); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got wrong answers, want=%v, got=%v", tt.name, tt.want, got)
+		}
+	}
+
+	// the server follows the checkpoint
+	if err = saveHostsCheckpoint(file, exampleHosts[1:], defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+	// make sure the modification time changes on coarse filesystems
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := queryDNS(t, addr, "kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA)
+	if m.Rcode != utildns.RcodeNameError {
+		t.Errorf("expected the removed member to be unknown, got rcode %d", m.Rcode)
+	}
+}
+
+func TestDNSServerSRVFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hostsFile := path.Join(dir, etcdHostsFilename)
+	if err = saveHostsCheckpoint(hostsFile, exampleHosts, defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+	srvFile := path.Join(dir, "etcd-srv.zone")
+	if err = ioutil.WriteFile(srvFile, getSRVZoneBytes(exampleHosts, defaultClusterDomain), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startDNSServer(t, dnsCheckpoint{hostsFile: hostsFile, srvFile: srvFile}, "")
+	defer s.conn.Close()
+
+	// the ports of the SRV file are served
+	_, answers := queryDNS(t, s.conn.LocalAddr().String(), "_etcd-server._tcp.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeSRV)
+	want := []string{
+		"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.:2380",
+		"node-1.kube-etcd.kube-system.svc.cluster.local.:12380",
+	}
+	if got := answerData(t, answers); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong answers, want=%v, got=%v", want, got)
+	}
+}
+
+func TestDNSServerManagedBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "hosts")
+	if err = ioutil.WriteFile(file, []byte("10.9.9.9 kube-etcd-0009.kube-etcd.kube-system.svc.cluster.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = saveHostsBlock(file, exampleHosts[:1], defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startDNSServer(t, dnsCheckpoint{hostsFile: file, managedBlock: true}, "")
+	defer s.conn.Close()
+	addr := s.conn.LocalAddr().String()
+
+	_, answers := queryDNS(t, addr, "kube-etcd-0000.kube-etcd.", utildns.TypeA)
+	if got := answerData(t, answers); !reflect.DeepEqual(got, []string{"10.2.0.5"}) {
+		t.Errorf("got wrong answers %v", got)
+	}
+	// the lines outside of the block are not served
+	m, _ := queryDNS(t, addr, "kube-etcd-0009.kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA)
+	if m.Rcode != utildns.RcodeNameError {
+		t.Errorf("expected a name error, got rcode %d", m.Rcode)
+	}
+}
+
+func TestDNSServerForward(t *testing.T) {
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q, err := utildns.Parse(buf[:n])
+			if err != nil {
+				continue
+			}
+			r := q.Reply(utildns.RcodeSuccess)
+			r.RecursionAvailable = true
+			r.Answers = []utildns.Resource{utildns.NewA(q.Questions[0].Name, net.ParseIP("93.184.216.34"), 60)}
+			b, _ := r.Pack()
+			upstream.WriteTo(b, addr)
+		}
+	}()
+
+	s := startDNSServer(t, dnsCheckpoint{hostsFile: path.Join(os.TempDir(), "kenc-missing-checkpoint")}, upstream.LocalAddr().String())
+	defer s.conn.Close()
+
+	m, answers := queryDNS(t, s.conn.LocalAddr().String(), "example.com.", utildns.TypeA)
+	if m.Rcode != utildns.RcodeSuccess || !m.RecursionAvailable {
+		t.Errorf("expected the upstream response, got %+v", m)
+	}
+	if got := answerData(t, answers); !reflect.DeepEqual(got, []string{"93.184.216.34"}) {
+		t.Errorf("got wrong answers %v", got)
+	}
+
+	// the etcd zone is not forwarded
+	m, _ = queryDNS(t, s.conn.LocalAddr().String(), "kube-etcd.kube-system.svc.cluster.local.", utildns.TypeA)
+	if m.Rcode != utildns.RcodeNameError {
+		t.Errorf("expected a name error without checkpoint, got rcode %d", m.Rcode)
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
+	"net"
 	"path"
+	"strconv"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -18,13 +18,33 @@ import (
 const (
 	endpointsCheckpointFile = "endpoints.checkpoint"
 
-	cluterLabel = "etcd_cluster"
-	clusterName = "kube-etcd"
-	appLabel    = "app"
-	appName     = "etcd"
-	clientPort  = "2379"
+	defaultEtcdSelector  = "etcd_cluster=kube-etcd,app=etcd"
+	defaultEtcdNamespace = api.NamespaceSystem
+	defaultEtcdService   = "kube-etcd"
 )
 
+// clientPort returns the etcd client port of the endpoints.
+func clientPort() string {
+	return strconv.Itoa(etcdClientPort)
+}
+
+// validateEtcdSelection returns an error if the given etcd pod selector,
+// namespace, service name or client port is invalid.
+func validateEtcdSelection(selector, namespace, service string, port int) error {
+	if _, err := labels.Parse(selector); err != nil {
+		return fmt.Errorf("selector: %v", err)
+	}
+	switch {
+	case len(namespace) == 0:
+		return fmt.Errorf("namespace must not be empty")
+	case len(service) == 0:
+		return fmt.Errorf("service must not be empty")
+	case port < 1 || port > 65535:
+		return fmt.Errorf("client port %d out of range", port)
+	}
+	return nil
+}
+
 type Endpoints struct {
 	Endpoints []string `json:"endpoints"`
 }
@@ -40,8 +60,10 @@ func newEndpointCheckpointer(kubecli kubernetes.Interface) *endpointsCheckpointe
 	}
 }
 
-func (ec *endpointsCheckpointer) checkpoint() error {
-	eps, err := getEndpoints(ec.kubecli)
+// checkpoint checkpoints the etcd endpoints, listing the etcd pods with the
+// given label selector.
+func (ec *endpointsCheckpointer) checkpoint(selector string) error {
+	eps, err := getEtcdEndpoints(ec.kubecli, etcdSource, selector, ec.endpoints)
 	if err != nil {
 		return err
 	}
@@ -56,22 +78,7 @@ func (ec *endpointsCheckpointer) checkpoint() error {
 		return err
 	}
 
-	// TODO: return if there is no change
-	// TODO: create temp file to make save atomic
-	f, err := os.Create(path.Join(checkpointDir, endpointsCheckpointFile))
-	if err != nil {
-		return err
-	}
-
-	n, err := f.Write(b)
-	if err == nil && n < len(b) {
-		return io.ErrShortWrite
-	}
-	if err != nil {
-		return err
-	}
-
-	return f.Sync()
+	return writeCheckpoint(checkpointDir, endpointsCheckpointFile, b)
 }
 
 // getEndpointsFromCheckpoint returns the endpoints from a previous checkpoint file.
@@ -89,15 +96,10 @@ func getEndpointsFromCheckpoint() ([]string, error) {
 	return eps.Endpoints, nil
 }
 
-func getEndpoints(kubecli kubernetes.Interface) ([]string, error) {
-	ls := map[string]string{
-		cluterLabel: clusterName,
-		appLabel:    appName,
-	}
-
+func getEndpoints(kubecli kubernetes.Interface, selector string) ([]string, error) {
 	// TODO: use client side cache
-	lo := metav1.ListOptions{LabelSelector: labels.SelectorFromSet(ls).String()}
-	podList, err := kubecli.Core().Pods(api.NamespaceSystem).List(lo)
+	lo := metav1.ListOptions{LabelSelector: selector}
+	podList, err := kubecli.Core().Pods(etcdNamespace).List(lo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list running self hosted etcd pods: %v", err)
 	}
@@ -108,7 +110,7 @@ func getEndpoints(kubecli kubernetes.Interface) ([]string, error) {
 
 		switch pod.Status.Phase {
 		case v1.PodRunning:
-			endpoints = append(endpoints, pod.Status.PodIP+":"+clientPort)
+			endpoints = append(endpoints, net.JoinHostPort(pod.Status.PodIP, clientPort()))
 		}
 	}
 
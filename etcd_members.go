@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+)
+
+// the time to wait for the etcd member list
+var memberListTimeout = 5 * time.Second
+
+// getMemberEndpointsOrFallback returns the client endpoints of the member
+// list of the given current endpoints, else of the endpoints checkpoint. It
+// returns the fallback endpoints if there are no current endpoints, the
+// member list fails, e.g. as a member cannot be resolved, or it has none.
+func getMemberEndpointsOrFallback(current []string, tlsFiles utiletcd.TLSFiles, fallback func() ([]string, error)) ([]string, error) {
+	if len(current) == 0 {
+		current, _ = getEndpointsFromCheckpoint()
+	}
+	if len(current) == 0 {
+		// nothing to ask yet, e.g. on the first checkpoint
+		return fallback()
+	}
+	eps, err := utiletcd.MemberEndpoints(current, tlsFiles, memberListTimeout)
+	if err == nil && len(eps) == 0 {
+		err = fmt.Errorf("no etcd member has a client url")
+	}
+	if err != nil {
+		log.Printf("falling back to the etcd pods: %v", err)
+		return fallback()
+	}
+	return eps, nil
+}
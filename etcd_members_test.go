@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+)
+
+func TestGetMemberEndpointsFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, oldTimeout := checkpointDir, memberListTimeout
+	defer func() {
+		checkpointDir, memberListTimeout = oldDir, oldTimeout
+	}()
+	checkpointDir = dir
+	memberListTimeout = 500 * time.Millisecond
+
+	pods := []string{"10.2.0.5:2379"}
+	fallback := func() ([]string, error) {
+		return pods, nil
+	}
+
+	// no current endpoints and no checkpoint
+	got, err := getMemberEndpointsOrFallback(nil, utiletcd.TLSFiles{}, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pods) {
+		t.Errorf("got wrong endpoints without current endpoints, want=%v, got=%v", pods, got)
+	}
+
+	// the member list fails
+	tlsFiles := utiletcd.TLSFiles{CAFile: dir + "/missing-ca.crt"}
+	got, err = getMemberEndpointsOrFallback([]string{"10.2.0.4:2379"}, tlsFiles, fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pods) {
+		t.Errorf("got wrong endpoints of a failed member list, want=%v, got=%v", pods, got)
+	}
+}
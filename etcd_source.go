@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// the sources of the etcd members
+const (
+	etcdSourcePods           = "pods"
+	etcdSourceEndpoints      = "endpoints"
+	etcdSourceEndpointSlices = "endpointslices"
+	etcdSourceMembers        = "members"
+)
+
+// the label of the endpoint slices of a service
+const endpointSliceServiceLabel = "kubernetes.io/service-name"
+
+// parseEtcdSource returns an error if the given etcd member source is
+// unknown.
+func parseEtcdSource(source string) error {
+	switch source {
+	case etcdSourcePods, etcdSourceEndpoints, etcdSourceEndpointSlices, etcdSourceMembers:
+		return nil
+	default:
+		return fmt.Errorf("unknown etcd source: %v", source)
+	}
+}
+
+// getEtcdHosts returns the named etcd members of the given source. The
+// members source has no host names, the pods matching the given label
+// selector are read instead.
+func getEtcdHosts(kubecli kubernetes.Interface, source, selector string) ([]*hostInfo, error) {
+	if source == etcdSourcePods || source == etcdSourceMembers {
+		return getHosts(kubecli, selector)
+	}
+	hosts, err := getServiceHosts(kubecli, source)
+	if err != nil {
+		return nil, err
+	}
+	var named []*hostInfo
+	for _, h := range hosts {
+		if len(h.HostName) > 0 {
+			named = append(named, h)
+		}
+	}
+	return named, nil
+}
+
+// getEtcdEndpoints returns the client endpoints of the etcd members of the
+// given source. The pods are listed with the given label selector, the
+// members source asks the given current endpoints.
+func getEtcdEndpoints(kubecli kubernetes.Interface, source, selector string, current []string) ([]string, error) {
+	switch source {
+	case etcdSourcePods:
+		return getEndpoints(kubecli, selector)
+	case etcdSourceMembers:
+		tlsFiles := utiletcd.TLSFiles{CAFile: etcdCAFile, CertFile: etcdCertFile, KeyFile: etcdKeyFile}
+		return getMemberEndpointsOrFallback(current, tlsFiles, func() ([]string, error) {
+			return getEndpoints(kubecli, selector)
+		})
+	}
+	hosts, err := getServiceHosts(kubecli, source)
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []string
+	for _, h := range hosts {
+		for _, ip := range h.IPs {
+			endpoints = append(endpoints, net.JoinHostPort(ip, strconv.Itoa(h.ClientPort)))
+		}
+	}
+	return endpoints, nil
+}
+
+// getServiceHosts returns the ready etcd members of the etcd service, read
+// from its Endpoints or EndpointSlices.
+func getServiceHosts(kubecli kubernetes.Interface, source string) ([]*hostInfo, error) {
+	switch source {
+	case etcdSourceEndpoints:
+		ep, err := kubecli.Core().Endpoints(etcdNamespace).Get(etcdService, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the etcd service endpoints: %v", err)
+		}
+		return endpointsHosts(ep), nil
+	case etcdSourceEndpointSlices:
+		// client-go does not know the discovery API yet, the slices are
+		// decoded from the raw response.
+		b, err := kubecli.Core().RESTClient().Get().
+			AbsPath("/apis/discovery.k8s.io/v1/namespaces", etcdNamespace, "endpointslices").
+			Param("labelSelector", endpointSliceServiceLabel+"="+etcdService).
+			DoRaw()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the etcd service endpoint slices: %v", err)
+		}
+		return endpointSliceHosts(b)
+	default:
+		return nil, parseEtcdSource(source)
+	}
+}
+
+// servicePort is a port of an etcd service endpoint.
+type servicePort struct {
+	name string
+	port int
+}
+
+// etcdServicePorts returns the client and peer ports of the given endpoint
+// ports. The client port is the port named client, else the only port. The
+// peer port is the port named peer or server, else the default peer port.
+func etcdServicePorts(ports []servicePort) (client, peer int, ok bool) {
+	peer = defaultPeerPort
+	for _, p := range ports {
+		switch p.name {
+		case "client":
+			client = p.port
+		case "peer", "server":
+			peer = p.port
+		}
+	}
+	if client == 0 && len(ports) == 1 {
+		client = ports[0].port
+	}
+	return client, peer, client != 0
+}
+
+// serviceHosts collects the hosts of the endpoints of the etcd service. The
+// addresses of the same host, e.g. of both families, are merged.
+type serviceHosts struct {
+	byKey map[string]*hostInfo
+	list  []*hostInfo
+}
+
+func (hs *serviceHosts) add(hostName, ip string, client, peer int) {
+	if hs.byKey == nil {
+		hs.byKey = map[string]*hostInfo{}
+	}
+	key := hostName
+	if len(key) == 0 {
+		key = ip
+	}
+	h, ok := hs.byKey[key]
+	if !ok {
+		h = &hostInfo{HostName: hostName, ClientPort: client, PeerPort: peer}
+		hs.byKey[key] = h
+		hs.list = append(hs.list, h)
+	}
+	for _, known := range h.IPs {
+		if known == ip {
+			return
+		}
+	}
+	h.IPs = append(h.IPs, ip)
+}
+
+func (hs *serviceHosts) sorted() []*hostInfo {
+	sort.Sort(hostInfosByName(hs.list))
+	return hs.list
+}
+
+// endpointHostName returns the host name of an endpoint: its hostname, else
+// the name of its pod.
+func endpointHostName(hostname string, targetRef *v1.ObjectReference) string {
+	if len(hostname) > 0 {
+		return hostname
+	}
+	if targetRef != nil && targetRef.Kind == "Pod" {
+		return targetRef.Name
+	}
+	return ""
+}
+
+// endpointsHosts returns the ready hosts of the given Endpoints.
+func endpointsHosts(ep *v1.Endpoints) []*hostInfo {
+	var hs serviceHosts
+	for _, subset := range ep.Subsets {
+		var ports []servicePort
+		for _, p := range subset.Ports {
+			ports = append(ports, servicePort{name: p.Name, port: int(p.Port)})
+		}
+		client, peer, ok := etcdServicePorts(ports)
+		if !ok {
+			log.Printf("no etcd client port in %v, skipping the endpoints of the subset", ports)
+			continue
+		}
+		// NotReadyAddresses are left out
+		for _, addr := range subset.Addresses {
+			hs.add(endpointHostName(addr.Hostname, addr.TargetRef), addr.IP, client, peer)
+		}
+	}
+	return hs.sorted()
+}
+
+// endpointSliceList is the part of a discovery.k8s.io/v1 EndpointSliceList
+// read by kenc.
+type endpointSliceList struct {
+	Items []struct {
+		AddressType string `json:"addressType"`
+		Endpoints   []struct {
+			Addresses  []string `json:"addresses"`
+			Conditions struct {
+				Ready *bool `json:"ready"`
+			} `json:"conditions"`
+			Hostname  string              `json:"hostname"`
+			TargetRef *v1.ObjectReference `json:"targetRef"`
+		} `json:"endpoints"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port *int32 `json:"port"`
+		} `json:"ports"`
+	} `json:"items"`
+}
+
+// endpointSliceHosts returns the ready hosts of the given EndpointSliceList.
+// An endpoint of unknown readiness is ready.
+func endpointSliceHosts(b []byte) ([]*hostInfo, error) {
+	var list endpointSliceList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("failed to decode the endpoint slices: %v", err)
+	}
+
+	var hs serviceHosts
+	for _, slice := range list.Items {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		var ports []servicePort
+		for _, p := range slice.Ports {
+			if p.Port != nil {
+				ports = append(ports, servicePort{name: p.Name, port: int(*p.Port)})
+			}
+		}
+		client, peer, ok := etcdServicePorts(ports)
+		if !ok {
+			log.Printf("no etcd client port in %v, skipping the endpoints of the slice", ports)
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, ip := range ep.Addresses {
+				hs.add(endpointHostName(ep.Hostname, ep.TargetRef), ip, client, peer)
+			}
+		}
+	}
+	return hs.sorted(), nil
+}
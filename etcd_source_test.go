@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func TestEtcdServicePorts(t *testing.T) {
+	tests := []struct {
+		ports  []servicePort
+		client int
+		peer   int
+		ok     bool
+	}{
+		{[]servicePort{{"", 2379}}, 2379, 2380, true},
+		{[]servicePort{{"peer", 12380}, {"client", 12379}}, 12379, 12380, true},
+		{[]servicePort{{"server", 12380}, {"client", 12379}, {"metrics", 2381}}, 12379, 12380, true},
+		{[]servicePort{{"peer", 2380}, {"metrics", 2381}}, 0, 2380, false},
+		{nil, 0, 2380, false},
+	}
+	for i, tt := range tests {
+		client, peer, ok := etcdServicePorts(tt.ports)
+		if client != tt.client || peer != tt.peer || ok != tt.ok {
+			t.Errorf("#%d: got wrong ports, want=%d %d %v, got=%d %d %v", i, tt.client, tt.peer, tt.ok, client, peer, ok)
+		}
+	}
+}
+
+func TestEndpointsHosts(t *testing.T) {
+	ep := &v1.Endpoints{
+		Subsets: []v1.EndpointSubset{
+			{
+				Addresses: []v1.EndpointAddress{
+					{IP: "10.2.1.7", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "kube-etcd-0001"}},
+					{IP: "10.2.0.5", Hostname: "kube-etcd-0000", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "kube-etcd-5gx2k"}},
+					{IP: "10.2.3.3"},
+				},
+				NotReadyAddresses: []v1.EndpointAddress{
+					{IP: "10.2.2.9", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "kube-etcd-0002"}},
+				},
+				Ports: []v1.EndpointPort{{Name: "client", Port: 2379}, {Name: "peer", Port: 2380}},
+			},
+			{
+				// no client port
+				Addresses: []v1.EndpointAddress{{IP: "10.2.4.4"}},
+				Ports:     []v1.EndpointPort{{Name: "metrics", Port: 2381}, {Name: "peer", Port: 2380}},
+			},
+		},
+	}
+	want := []*hostInfo{
+		{IPs: []string{"10.2.3.3"}, PeerPort: 2380, ClientPort: 2379},
+		{HostName: "kube-etcd-0000", IPs: []string{"10.2.0.5"}, PeerPort: 2380, ClientPort: 2379},
+		{HostName: "kube-etcd-0001", IPs: []string{"10.2.1.7"}, PeerPort: 2380, ClientPort: 2379},
+	}
+	if got := endpointsHosts(ep); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong hosts, want=%+v, got=%+v", want, got)
+	}
+}
+
+func TestEndpointSliceHosts(t *testing.T) {
+	b := []byte(`{
+  "kind": "EndpointSliceList",
+  "apiVersion": "discovery.k8s.io/v1",
+  "items": [
+    {
+      "metadata": {"name": "kube-etcd-abcde", "labels": {"kubernetes.io/service-name": "kube-etcd"}},
+      "addressType": "IPv4",
+      "endpoints": [
+        {"addresses": ["10.2.0.5"], "conditions": {"ready": true}, "hostname": "kube-etcd-0000", "targetRef": {"kind": "Pod", "name": "kube-etcd-0000"}},
+        {"addresses": ["10.2.1.7"], "conditions": {}, "targetRef": {"kind": "Pod", "name": "kube-etcd-0001"}},
+        {"addresses": ["10.2.2.9"], "conditions": {"ready": false}, "targetRef": {"kind": "Pod", "name": "kube-etcd-0002"}}
+      ],
+      "ports": [{"name": "client", "port": 12379, "protocol": "TCP"}, {"name": "peer", "port": 12380, "protocol": "TCP"}]
+    },
+    {
+      "metadata": {"name": "kube-etcd-fghij", "labels": {"kubernetes.io/service-name": "kube-etcd"}},
+      "addressType": "IPv6",
+      "endpoints": [
+        {"addresses": ["fd00:10:2::5"], "conditions": {"ready": true}, "hostname": "kube-etcd-0000"}
+      ],
+      "ports": [{"name": "client", "port": 12379, "protocol": "TCP"}, {"name": "peer", "port": 12380, "protocol": "TCP"}]
+    },
+    {
+      "metadata": {"name": "kube-etcd-klmno", "labels": {"kubernetes.io/service-name": "kube-etcd"}},
+      "addressType": "FQDN",
+      "endpoints": [{"addresses": ["etcd.example.org"]}],
+      "ports": [{"name": "client", "port": 2379}]
+    }
+  ]
+}`)
+	got, err := endpointSliceHosts(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*hostInfo{
+		{HostName: "kube-etcd-0000", IPs: []string{"10.2.0.5", "fd00:10:2::5"}, PeerPort: 12380, ClientPort: 12379},
+		{HostName: "kube-etcd-0001", IPs: []string{"10.2.1.7"}, PeerPort: 12380, ClientPort: 12379},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong hosts, want=%+v, got=%+v", want, got)
+	}
+
+	if _, err = endpointSliceHosts([]byte("<html>")); err == nil {
+		t.Error("expected failure for invalid response")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cmdEtcdFlags = "etcd-flags"
+
+// etcd-flags output formats
+const (
+	etcdFlagsFormatFlags = "flags"
+	etcdFlagsFormatEnv   = "env"
+	etcdFlagsFormatJSON  = "json"
+)
+
+// etcdMember is an etcd member of a checkpoint.
+type etcdMember struct {
+	Name      string `json:"name"`
+	PeerURL   string `json:"peerURL"`
+	ClientURL string `json:"clientURL"`
+}
+
+// etcdFlags are the etcd flags of the members of a checkpoint.
+type etcdFlags struct {
+	// the checkpoint the flags are generated from
+	Checkpoint     string       `json:"checkpoint"`
+	InitialCluster string       `json:"initialCluster"`
+	Endpoints      string       `json:"endpoints"`
+	Members        []etcdMember `json:"members"`
+}
+
+// newEtcdFlags returns the flags of the given hosts. The URLs use the first
+// address of the hosts, or their fully qualified name if useNames is true.
+func newEtcdFlags(hosts []*hostInfo, scheme string, useNames bool, domain string) *etcdFlags {
+	f := &etcdFlags{}
+	var cluster, endpoints []string
+	for _, h := range hosts {
+		addr := h.IPs[0]
+		if useNames {
+			addr = hostNames(h.HostName, domain)[0]
+		}
+		m := etcdMember{
+			Name:      h.HostName,
+			PeerURL:   scheme + "://" + net.JoinHostPort(addr, strconv.Itoa(h.PeerPort)),
+			ClientURL: scheme + "://" + net.JoinHostPort(addr, strconv.Itoa(h.ClientPort)),
+		}
+		f.Members = append(f.Members, m)
+		cluster = append(cluster, m.Name+"="+m.PeerURL)
+		endpoints = append(endpoints, m.ClientURL)
+	}
+	f.InitialCluster = strings.Join(cluster, ",")
+	f.Endpoints = strings.Join(endpoints, ",")
+	return f
+}
+
+// write writes the flags in the given format.
+func (f *etcdFlags) write(w io.Writer, format string) error {
+	var err error
+	switch format {
+	case etcdFlagsFormatFlags:
+		_, err = fmt.Fprintf(w, "--initial-cluster=%s\n--endpoints=%s\n", f.InitialCluster, f.Endpoints)
+	case etcdFlagsFormatEnv:
+		_, err = fmt.Fprintf(w, "# generated by kenc from %s\nETCD_INITIAL_CLUSTER=%s\nETCDCTL_ENDPOINTS=%s\n", f.Checkpoint, f.InitialCluster, f.Endpoints)
+	case etcdFlagsFormatJSON:
+		var b []byte
+		b, err = json.MarshalIndent(f, "", "  ")
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+	default:
+		err = fmt.Errorf("unknown format: %v", format)
+	}
+	return err
+}
+
+// memberHostName returns the host name of the given fully qualified member
+// name of the etcd service in the given domain, or "" if it is not one. The
+// host name of a hostNetwork member is its node name, which may be dotted.
+func memberHostName(name, domain string) string {
+	suffix := "." + strings.ToLower(serviceNames(domain)[0])
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !strings.HasSuffix(name, suffix) {
+		return ""
+	}
+	hostName := strings.TrimSuffix(name, suffix)
+	return hostName
+}
+
+// memberHosts collects the hosts of the members of a checkpoint.
+type memberHosts map[string]*hostInfo
+
+func (hs memberHosts) get(hostName string) *hostInfo {
+	h, ok := hs[hostName]
+	if !ok {
+		h = &hostInfo{HostName: hostName, PeerPort: defaultPeerPort, ClientPort: etcdClientPort}
+		hs[hostName] = h
+	}
+	return h
+}
+
+// list returns the hosts with an address, sorted by name.
+func (hs memberHosts) list() []*hostInfo {
+	var list []*hostInfo
+	for _, h := range hs {
+		if len(h.IPs) > 0 {
+			list = append(list, h)
+		}
+	}
+	sort.Sort(hostInfosByName(list))
+	return list
+}
+
+// parseHostsCheckpoint returns the members of the given hosts checkpoint, on
+// the etcd client port and the default peer port.
+func parseHostsCheckpoint(b []byte, managedBlock bool, domain string) []*hostInfo {
+	hs := memberHosts{}
+	for _, fields := range hostsCheckpointLines(b, managedBlock) {
+		if hostName := memberHostName(fields[1], domain); len(hostName) > 0 {
+			h := hs.get(hostName)
+			h.IPs = append(h.IPs, fields[0])
+		}
+	}
+	return hs.list()
+}
+
+// parseSRVCheckpoint returns the members of the given SRV zone file fragment,
+// as written by getSRVZoneBytes.
+func parseSRVCheckpoint(b []byte, domain string) []*hostInfo {
+	hs := memberHosts{}
+	zone := strings.ToLower(serviceNames(domain)[0]) + "."
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		// <name> <ttl> IN <type> <data>...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || strings.HasPrefix(fields[0], ";") || fields[2] != "IN" {
+			continue
+		}
+		switch fields[3] {
+		case "A", "AAAA":
+			hostName := memberHostName(fields[0], domain)
+			if len(hostName) > 0 && net.ParseIP(fields[4]) != nil {
+				h := hs.get(hostName)
+				h.IPs = append(h.IPs, fields[4])
+			}
+		case "SRV":
+			if len(fields) != 8 {
+				continue
+			}
+			hostName := memberHostName(fields[7], domain)
+			port, err := strconv.Atoi(fields[6])
+			if len(hostName) == 0 || err != nil {
+				continue
+			}
+			switch strings.ToLower(fields[0]) {
+			case srvServer + "." + zone:
+				hs.get(hostName).PeerPort = port
+			case srvClient + "." + zone:
+				hs.get(hostName).ClientPort = port
+			}
+		}
+	}
+	return hs.list()
+}
+
+// newestCheckpointHosts returns the members of the newest of the given
+// checkpoint files that has any, and its name.
+func newestCheckpointHosts(files []string, parse map[string]func([]byte) []*hostInfo) ([]*hostInfo, string, error) {
+	var (
+		newest     []*hostInfo
+		newestFile string
+		newestTime time.Time
+	)
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, "", err
+		}
+		if newest != nil && !fi.ModTime().After(newestTime) {
+			continue
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, "", err
+		}
+		if hosts := parse[file](b); len(hosts) > 0 {
+			newest, newestFile, newestTime = hosts, file, fi.ModTime()
+		}
+	}
+	if newest == nil {
+		return nil, "", fmt.Errorf("no etcd members in %s", strings.Join(files, ", "))
+	}
+	return newest, newestFile, nil
+}
+
+// runEtcdFlags runs the etcd-flags command with the given arguments. It
+// prints the etcd flags of the members of the newest hosts or SRV
+// checkpoint.
+func runEtcdFlags(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(cmdEtcdFlags, flag.ContinueOnError)
+	config := fs.String("config", "", "the kenc YAML or JSON configuration file of the checkpoints")
+	format := fs.String("format", etcdFlagsFormatFlags, "the output format (flags/env/json)")
+	scheme := fs.String("scheme", "https", "the scheme of the URLs")
+	useNames := fs.Bool("use-names", false, "use the DNS names of the members instead of their ips in the URLs")
+	hostsDir := fs.String("hosts-dir", etcdDir, "the directory of the etcd hosts checkpoint")
+	hostsFile := fs.String("hosts-file", "", "the etcd hosts checkpoint file; "+etcdHostsFilename+" in -hosts-dir if empty")
+	managedBlock := fs.Bool("hosts-managed-block", false, "read the etcd hosts from the kenc managed block of -hosts-file")
+	srvFile := fs.String("hosts-srv-file", "", "the etcd SRV checkpoint file")
+	domain := fs.String("cluster-domain", defaultClusterDomain, "the DNS domain of the kubernetes cluster")
+	fs.StringVar(&etcdNamespace, "etcd-namespace", defaultEtcdNamespace, "the namespace of the etcd service")
+	fs.StringVar(&etcdService, "etcd-service", defaultEtcdService, "the name of the etcd service")
+	fs.IntVar(&etcdClientPort, "etcd-client-port", defaultClientPort, "the client port of the members of the hosts checkpoint")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch *format {
+	case etcdFlagsFormatFlags, etcdFlagsFormatEnv, etcdFlagsFormatJSON:
+	default:
+		return fmt.Errorf("unknown format: %v", *format)
+	}
+	if *config != "" {
+		if err := loadConfigFile(fs, *config); err != nil {
+			return err
+		}
+	}
+
+	if *hostsFile == "" {
+		*hostsFile = filepath.Join(*hostsDir, etcdHostsFilename)
+	}
+	files := []string{*hostsFile}
+	parse := map[string]func([]byte) []*hostInfo{
+		*hostsFile: func(b []byte) []*hostInfo {
+			return parseHostsCheckpoint(b, *managedBlock, *domain)
+		},
+	}
+	if *srvFile != "" {
+		// prefer the SRV checkpoint, it has the ports
+		files = []string{*srvFile, *hostsFile}
+		parse[*srvFile] = func(b []byte) []*hostInfo {
+			return parseSRVCheckpoint(b, *domain)
+		}
+	}
+
+	hosts, file, err := newestCheckpointHosts(files, parse)
+	if err != nil {
+		return err
+	}
+	f := newEtcdFlags(hosts, *scheme, *useNames, *domain)
+	f.Checkpoint = file
+	return f.write(out, *format)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseHostsCheckpoint(t *testing.T) {
+	b := append([]byte("127.0.0.1 localhost\n"), getHostsBytes(exampleHosts, defaultClusterDomain)...)
+	got := parseHostsCheckpoint(b, false, defaultClusterDomain)
+	want := []*hostInfo{
+		{HostName: "kube-etcd-0000", IPs: []string{"10.2.0.5"}, PeerPort: 2380, ClientPort: 2379},
+		{HostName: "node-1", IPs: []string{"172.17.4.101", "fd00::101"}, PeerPort: 2380, ClientPort: 2379},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong hosts, want=%+v, got=%+v", want, got)
+	}
+
+	// only the managed block is read
+	b, err := replaceHostsBlock([]byte("10.9.9.9 kube-etcd-0009.kube-etcd.kube-system.svc.cluster.local\n"), getHostsBytes(exampleHosts[:1], defaultClusterDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = parseHostsCheckpoint(b, true, defaultClusterDomain)
+	if !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("got wrong hosts of the managed block, want=%+v, got=%+v", want[:1], got)
+	}
+}
+
+func TestMemberHostName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local", "kube-etcd-0000"},
+		{"kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", "kube-etcd-0000"},
+		{"ip-10-0-0-1.ec2.internal.kube-etcd.kube-system.svc.cluster.local", "ip-10-0-0-1.ec2.internal"},
+		{"kube-etcd-0000.kube-etcd.kube-system.svc", ""},
+		{"kube-etcd-0000.kube-dns.kube-system.svc.cluster.local", ""},
+		{"kube-etcd.kube-system.svc.cluster.local", ""},
+	}
+	for _, tt := range tests {
+		if got := memberHostName(tt.name, defaultClusterDomain); got != tt.want {
+			t.Errorf("got wrong host name of %s, want=%q, got=%q", tt.name, tt.want, got)
+		}
+	}
+
+	// dotted node names survive the hosts checkpoint
+	hosts := []*hostInfo{{HostName: "ip-10-0-0-1.ec2.internal", IPs: []string{"10.0.0.1"}, PeerPort: 2380, ClientPort: 2379}}
+	got := parseHostsCheckpoint(getHostsBytes(hosts, defaultClusterDomain), false, defaultClusterDomain)
+	if !reflect.DeepEqual(got, hosts) {
+		t.Errorf("got wrong hosts, want=%+v, got=%+v", hosts, got)
+	}
+}
+
+func TestParseSRVCheckpoint(t *testing.T) {
+	got := parseSRVCheckpoint(getSRVZoneBytes(exampleHosts, defaultClusterDomain), defaultClusterDomain)
+	if !reflect.DeepEqual(got, exampleHosts) {
+		t.Errorf("got wrong hosts, want=%+v, got=%+v", exampleHosts, got)
+	}
+	if got = parseSRVCheckpoint(getSRVZoneBytes(exampleHosts, defaultClusterDomain), "example.org"); len(got) != 0 {
+		t.Errorf("expected no hosts of another domain, got %+v", got)
+	}
+}
+
+func TestEtcdFlagsFormats(t *testing.T) {
+	f := newEtcdFlags(exampleHosts, "https", false, defaultClusterDomain)
+	f.Checkpoint = "/var/etcd/etcd-srv.zone"
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{etcdFlagsFormatFlags, `--initial-cluster=kube-etcd-0000=https://10.2.0.5:2380,node-1=https://172.17.4.101:12380
+--endpoints=https://10.2.0.5:2379,https://172.17.4.101:12379
+`},
+		{etcdFlagsFormatEnv, `# generated by kenc from /var/etcd/etcd-srv.zone
+ETCD_INITIAL_CLUSTER=kube-etcd-0000=https://10.2.0.5:2380,node-1=https://172.17.4.101:12380
+ETCDCTL_ENDPOINTS=https://10.2.0.5:2379,https://172.17.4.101:12379
+`},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := f.write(&buf, tt.format); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != tt.want {
+			t.Errorf("%s: got wrong output", tt.format)
+			t.Errorf("want: %s", tt.want)
+			t.Errorf("got: %s", buf.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := f.write(&buf, etcdFlagsFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var got etcdFlags
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, f) {
+		t.Errorf("got wrong json, want=%+v, got=%+v", f, got)
+	}
+
+	f = newEtcdFlags(exampleHosts[:1], "http", true, defaultClusterDomain)
+	if want := "kube-etcd-0000=http://kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local:2380"; f.InitialCluster != want {
+		t.Errorf("got wrong initial cluster with names, want=%s, got=%s", want, f.InitialCluster)
+	}
+
+	f = newEtcdFlags([]*hostInfo{{HostName: "kube-etcd-0000", IPs: []string{"fd00::5"}, PeerPort: 2380, ClientPort: 2379}}, "https", false, defaultClusterDomain)
+	if want := "https://[fd00::5]:2379"; f.Endpoints != want {
+		t.Errorf("got wrong IPv6 endpoints, want=%s, got=%s", want, f.Endpoints)
+	}
+}
+
+func TestRunEtcdFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err = runEtcdFlags([]string{"-hosts-dir", dir}, &buf); err == nil {
+		t.Error("expected failure without checkpoint")
+	}
+
+	hostsFile := path.Join(dir, etcdHostsFilename)
+	srvFile := path.Join(dir, "etcd-srv.zone")
+	if err = saveHostsCheckpoint(hostsFile, exampleHosts, defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(srvFile, getSRVZoneBytes(exampleHosts, defaultClusterDomain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile := path.Join(dir, "kenc.yaml")
+	err = ioutil.WriteFile(configFile, []byte("version: v1\ncheckpointDir: /var/lib/kenc\nhostsDir: "+dir+"\nhosts:\n  srvFile: "+srvFile+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the SRV checkpoint has the ports
+	if err = runEtcdFlags([]string{"-config", configFile, "-format", "env"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# generated by kenc from " + srvFile + "\nETCD_INITIAL_CLUSTER=kube-etcd-0000=https://10.2.0.5:2380,node-1=https://172.17.4.101:12380\nETCDCTL_ENDPOINTS=https://10.2.0.5:2379,https://172.17.4.101:12379\n"
+	if buf.String() != want {
+		t.Errorf("got wrong output, want=%q, got=%q", want, buf.String())
+	}
+
+	// a newer hosts checkpoint takes precedence
+	if err = saveHostsCheckpoint(hostsFile, exampleHosts[:1], defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(hostsFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err = runEtcdFlags([]string{"-config", configFile}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	want = "--initial-cluster=kube-etcd-0000=https://10.2.0.5:2380\n--endpoints=https://10.2.0.5:2379\n"
+	if buf.String() != want {
+		t.Errorf("got wrong output, want=%q, got=%q", want, buf.String())
+	}
+
+	if err = runEtcdFlags([]string{"-hosts-dir", dir, "-format", "yaml"}, &buf); err == nil {
+		t.Error("expected failure for unknown format")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// fallbackRouting is the checkpointed etcd routing kenc installs while
+// kube-proxy has not programmed the etcd service ip.
+type fallbackRouting interface {
+	// install installs the checkpointed routing.
+	install() error
+	// remove removes the routing installed by install.
+	remove() error
+}
+
+// fallbackRoutings installs the routings in order and removes them in
+// reverse order.
+type fallbackRoutings []fallbackRouting
+
+func (rs fallbackRoutings) install() error {
+	for _, r := range rs {
+		if err := r.install(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs fallbackRoutings) remove() error {
+	for i := len(rs) - 1; i >= 0; i-- {
+		if err := rs[i].remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpointsFallback routes the etcd service ip to the checkpointed endpoints
+// with the endpoints datapaths.
+type endpointsFallback struct {
+	dps []endpointsDatapath
+}
+
+func (f *endpointsFallback) install() error {
+	eps, err := getEndpointsFromCheckpoint()
+	if err != nil {
+		return err
+	}
+	for _, dp := range f.dps {
+		err = dp.ensureRoute()
+		if err != nil {
+			return err
+		}
+	}
+	return syncEndpoints(f.dps, eps)
+}
+
+func (f *endpointsFallback) remove() error {
+	for _, dp := range f.dps {
+		err := dp.removeRoute()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iptablesFallback restores the checkpointed kube-proxy rules. kube-proxy
+// takes the restored chains over on its next sync, rewriting them without
+// the kenc-restored comment. The restored rules it did not rewrite are
+// removed with the chains only they used.
+type iptablesFallback struct{}
+
+func (f *iptablesFallback) install() error {
+	p, err := restoreIPtablesFromFile(ipt, vip, iptSelection.tables, path.Join(checkpointDir, iptablesCheckpointFile))
+	if err != nil {
+		return err
+	}
+	log.Printf("iptables: %s", p)
+
+	if ip6t != nil {
+		p, err = restoreIPtablesFromFile(ip6t, vip6, iptSelection.tables, path.Join(checkpointDir, ip6tablesCheckpointFile))
+		if err != nil {
+			return err
+		}
+		log.Printf("ip6tables: %s", p)
+	}
+	return nil
+}
+
+func (f *iptablesFallback) remove() error {
+	if err := removeRestoredRules(ipt, iptSelection.tables); err != nil {
+		return err
+	}
+	if ip6t != nil {
+		return removeRestoredRules(ip6t, iptSelection.tables)
+	}
+	return nil
+}
+
+// fallbackController installs the fallback routing while kube-proxy has not
+// programmed the etcd service ip, and hands the routing back to kube-proxy
+// once it has and the endpoints it forwards to match the running etcd pods.
+type fallbackController struct {
+	routing   fallbackRouting
+	installed bool
+}
+
+// sync installs or removes the fallback routing given whether kube-proxy
+// programmed the etcd service ip and the endpoints it forwards to.
+// getEndpoints returns the endpoints of the running etcd pods; it is only
+// called when the routing may be handed back.
+func (c *fallbackController) sync(programmed bool, live []string, getEndpoints func() ([]string, error)) error {
+	switch {
+	case !programmed && !c.installed:
+		if err := c.routing.install(); err != nil {
+			return fmt.Errorf("failed to install checkpointed routing: %v", err)
+		}
+		c.installed = true
+		log.Printf("kube-proxy has not programmed the etcd service ip, installed the checkpointed routing")
+
+	case programmed && c.installed:
+		eps, err := getEndpoints()
+		if err != nil {
+			return fmt.Errorf("cannot confirm the etcd endpoints of kube-proxy: %v", err)
+		}
+		if !sameEndpoints(live, eps) {
+			return nil
+		}
+		if err = c.routing.remove(); err != nil {
+			return fmt.Errorf("failed to remove checkpointed routing: %v", err)
+		}
+		c.installed = false
+		log.Printf("kube-proxy has programmed the etcd service ip, handed the routing back")
+	}
+	return nil
+}
+
+// sameEndpoints returns true if the given endpoints hold the same elements.
+func sameEndpoints(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// isEtcdServiceSynced returns true if kube-proxy has programmed the etcd
+// service ip in the given NAT table. The rules of the etcd service must not
+// be restored ones, kube-proxy did not sync the service while they are
+// live. The rules of the other services are not considered.
+func isEtcdServiceSynced(nat *iptablesTable, vip string) bool {
+	svc, ok := getEtcdServiceChain(nat, vip)
+	if !ok {
+		return false
+	}
+	chains := nat.closure([]utiliptables.Chain{svc})
+	for _, r := range nat.rules {
+		etcd := chains[r.chain] || (r.chain == kubeServicesChain && r.target() == string(svc))
+		if etcd && r.isRestored() {
+			return false
+		}
+	}
+	return true
+}
+
+// getKubeProxyEtcdEndpoints returns whether kube-proxy programmed the etcd
+// service ips of all enabled address families, and the endpoints it
+// forwards them to. The rules restored by the fallback do not count as
+// programmed by kube-proxy.
+func getKubeProxyEtcdEndpoints() (bool, []string, error) {
+	ipts := []utiliptables.Interface{ipt}
+	vips := []string{vip}
+	if ip6t != nil {
+		ipts = append(ipts, ip6t)
+		vips = append(vips, vip6)
+	}
+
+	programmed := true
+	var endpoints []string
+	for i := range ipts {
+		b, err := ipts[i].Save(utiliptables.TableNAT)
+		if err != nil {
+			return false, nil, err
+		}
+		nat, err := parseTable(utiliptables.TableNAT, b)
+		if err != nil {
+			return false, nil, err
+		}
+		programmed = programmed && isEtcdServiceSynced(nat, vips[i])
+		endpoints = append(endpoints, getEtcdServiceEndpoints(nat, vips[i])...)
+	}
+	return programmed, endpoints, nil
+}
+
+// runFallback keeps the given fallback routing in sync with the kube-proxy
+// rules until the process exits.
+func runFallback(routing fallbackRouting) {
+	c := &fallbackController{routing: routing}
+
+	var kubecli kubernetes.Interface
+	getLiveEndpoints := func() ([]string, error) {
+		if kubecli == nil {
+			var err error
+			kubecli, err = newKubeClient()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return getEtcdEndpoints(kubecli, etcdSource, etcdSelector, nil)
+	}
+
+	ticker := time.NewTicker(checkpointInterval)
+
+	for {
+		programmed, live, err := getKubeProxyEtcdEndpoints()
+		if err != nil {
+			log.Printf("failed to inspect the kube-proxy rules: %v", err)
+		} else if err = c.sync(programmed, live, getLiveEndpoints); err != nil {
+			log.Print(err)
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+type fakeFallbackRouting struct {
+	installs int
+	removes  int
+}
+
+func (f *fakeFallbackRouting) install() error {
+	f.installs++
+	return nil
+}
+
+func (f *fakeFallbackRouting) remove() error {
+	f.removes++
+	return nil
+}
+
+func TestFallbackControllerSync(t *testing.T) {
+	routing := &fakeFallbackRouting{}
+	c := &fallbackController{routing: routing}
+
+	live := []string{"10.2.0.4:2379", "10.2.0.5:2379"}
+	apiErr := errors.New("connection refused")
+	var apiEps []string
+	getEndpoints := func() ([]string, error) { return apiEps, apiErr }
+
+	// cold start, kube-proxy is not up
+	if err := c.sync(false, nil, getEndpoints); err != nil {
+		t.Fatal(err)
+	}
+	if routing.installs != 1 || !c.installed {
+		t.Fatalf("expected the routing to be installed, got %d installs", routing.installs)
+	}
+
+	// nothing changes until kube-proxy programmed the service ip
+	if err := c.sync(false, nil, getEndpoints); err != nil {
+		t.Fatal(err)
+	}
+	if routing.installs != 1 {
+		t.Errorf("expected the routing to be installed once, got %d installs", routing.installs)
+	}
+
+	// kube-proxy is up, but the endpoints cannot be confirmed yet
+	if err := c.sync(true, live, getEndpoints); err == nil {
+		t.Error("expected failure without the etcd endpoints")
+	}
+	apiErr = nil
+	apiEps = []string{"10.2.0.4:2379"}
+	if err := c.sync(true, live, getEndpoints); err != nil {
+		t.Fatal(err)
+	}
+	if routing.removes != 0 || !c.installed {
+		t.Error("expected the routing to be kept while the endpoints differ")
+	}
+
+	// kube-proxy is synced with the running etcd pods
+	apiEps = []string{"10.2.0.5:2379", "10.2.0.4:2379"}
+	if err := c.sync(true, live, getEndpoints); err != nil {
+		t.Fatal(err)
+	}
+	if routing.removes != 1 || c.installed {
+		t.Error("expected the routing to be handed back")
+	}
+
+	// kube-proxy rules are gone again
+	if err := c.sync(false, nil, getEndpoints); err != nil {
+		t.Fatal(err)
+	}
+	if routing.installs != 2 {
+		t.Errorf("expected the routing to be installed again, got %d installs", routing.installs)
+	}
+}
+
+func TestGetEtcdServiceEndpoints(t *testing.T) {
+	nat, err := parseTable(utiliptables.TableNAT, exampleTablesV124)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := getEtcdServiceEndpoints(nat, "10.96.0.15")
+	want := []string{"10.244.1.7:2379", "10.244.2.9:2379"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong endpoints: want %v, got %v", want, got)
+	}
+
+	if got = getEtcdServiceEndpoints(nat, "10.3.0.15"); got != nil {
+		t.Errorf("expected no endpoints, got %v", got)
+	}
+}
+
+func TestIsEtcdServiceSynced(t *testing.T) {
+	// the live rules are the restored checkpoint
+	restored, err := parseTable(utiliptables.TableNAT, markRestoredLines(exampleTablesV124))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEtcdServiceSynced(restored, "10.96.0.15") {
+		t.Error("expected the restored rules not to count as synced by kube-proxy")
+	}
+
+	// kube-proxy rewrote the very same rules
+	nat, err := parseTable(utiliptables.TableNAT, exampleTablesV124)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEtcdServiceSynced(nat, "10.96.0.15") {
+		t.Error("expected the identical rules rewritten by kube-proxy to be synced")
+	}
+	if isEtcdServiceSynced(nat, "10.96.0.10") {
+		t.Error("expected no etcd service rules for the dns service ip")
+	}
+
+	// kube-proxy only rewrote another service
+	var lines []string
+	for _, line := range strings.Split(string(markRestoredLines(exampleTablesV124)), "\n") {
+		if strings.Contains(line, "kube-system/kube-dns:dns-tcp") {
+			line = strings.Replace(line, " -m comment --comment "+kencRestoredComment, "", 1)
+		}
+		lines = append(lines, line)
+	}
+	other, err := parseTable(utiliptables.TableNAT, []byte(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEtcdServiceSynced(other, "10.96.0.15") {
+		t.Error("expected a sync of another service not to count as an etcd service sync")
+	}
+}
+
+func TestGetRestoredRulesRemoval(t *testing.T) {
+	live := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-ETCD - [0:0]
+:KUBE-SVC-GONE - [0:0]
+-A PREROUTING -j KUBE-SERVICES
+-A KUBE-SERVICES -d 10.96.0.15/32 -p tcp -m tcp --dport 2379 -j KUBE-SVC-ETCD
+-A KUBE-SERVICES -m comment --comment kenc-restored -d 10.96.0.20/32 -p tcp -m tcp --dport 80 -j KUBE-SVC-GONE
+-A KUBE-SVC-ETCD -j DNAT --to-destination 10.244.1.7:2379
+-A KUBE-SVC-GONE -m comment --comment kenc-restored -j DNAT --to-destination 10.244.1.9:80
+COMMIT
+`)
+	nat, err := parseTable(utiliptables.TableNAT, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(getRestoredRulesRemoval(nat))
+	want := `*nat
+-D KUBE-SERVICES -m comment --comment kenc-restored -d 10.96.0.20/32 -p tcp -m tcp --dport 80 -j KUBE-SVC-GONE
+-D KUBE-SVC-GONE -m comment --comment kenc-restored -j DNAT --to-destination 10.244.1.9:80
+-X KUBE-SVC-GONE
+COMMIT
+`
+	if got != want {
+		t.Error("got wrong removal")
+		t.Error(want)
+		t.Error(got)
+	}
+
+	nat, err = parseTable(utiliptables.TableNAT, exampleTablesV124)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := getRestoredRulesRemoval(nat); b != nil {
+		t.Errorf("expected nothing to remove, got %s", b)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// writeCheckpoint writes the given checkpoint into the given file in dir
+// atomically. The previous checkpointRetention checkpoints are kept as
+// <file>.1, the newest, to <file>.N. An unchanged checkpoint does not rotate
+// them.
+func writeCheckpoint(dir, filename string, b []byte) error {
+	if checkpointRetention > 0 {
+		if err := rotateCheckpoint(dir, filename, b, checkpointRetention); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(dir, filename, b)
+}
+
+// rotateCheckpoint shifts the kept checkpoints of the given file in dir and
+// links the current checkpoint as <file>.1 unless it has the given content.
+// At most n checkpoints are kept.
+func rotateCheckpoint(dir, filename string, b []byte, n int) error {
+	p := path.Join(dir, filename)
+	cur, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) || (err == nil && bytes.Equal(cur, b)) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i := n - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", p, i), fmt.Sprintf("%s.%d", p, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err = os.Remove(p + ".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the new checkpoint replaces the file, the link keeps the current one
+	return os.Link(p, p+".1")
+}
+
+// writeFileAtomic writes the given bytes into the given file in dir by
+// renaming a synced temporary file, so that readers either see the previous
+// or the new content.
+func writeFileAtomic(dir, filename string, b []byte) error {
+	return writeFileAtomicMode(dir, filename, b, 0600)
+}
+
+// writeFileAtomicMode is writeFileAtomic creating the file with the given
+// permissions.
+func writeFileAtomicMode(dir, filename string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(dir, "tmp-"+filename)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+
+	n, err := f.Write(b)
+	if err == nil && n < len(b) {
+		return io.ErrShortWrite
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path.Join(dir, filename))
+}
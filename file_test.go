@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestWriteCheckpointRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldRetention := checkpointRetention
+	defer func() {
+		checkpointRetention = oldRetention
+	}()
+	checkpointRetention = 2
+
+	for _, b := range []string{"a", "b", "b", "c", "d"} {
+		if err = writeCheckpoint(dir, "iptables.checkpoint", []byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"iptables.checkpoint", "d"},
+		{"iptables.checkpoint.1", "c"},
+		{"iptables.checkpoint.2", "b"},
+	}
+	for _, tt := range tests {
+		b, err := ioutil.ReadFile(path.Join(dir, tt.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("got wrong checkpoint %s, want=%q, got=%q", tt.file, tt.want, b)
+		}
+	}
+	if _, err = os.Stat(path.Join(dir, "iptables.checkpoint.3")); !os.IsNotExist(err) {
+		t.Errorf("expected no third previous checkpoint, got %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+)
+
+const (
+	defaultHealthCheckTimeout = time.Second
+	defaultHealthCheckFall    = 3
+	defaultHealthCheckRise    = 2
+)
+
+// endpointProber returns an error if the given endpoint is unhealthy.
+type endpointProber func(endpoint string) error
+
+// newEndpointProber returns the prober connecting to the endpoints within
+// the given timeout. If etcdHealth is true, it also asks the /health
+// endpoint of the etcd member, with the given TLS files.
+func newEndpointProber(timeout time.Duration, etcdHealth bool, tlsFiles utiletcd.TLSFiles) endpointProber {
+	return func(endpoint string) error {
+		conn, err := net.DialTimeout("tcp", endpoint, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		if etcdHealth {
+			return utiletcd.Health(endpoint, tlsFiles, timeout)
+		}
+		return nil
+	}
+}
+
+// endpointHealth is the health of a checkpointed endpoint.
+type endpointHealth struct {
+	// the consecutive failed and successful probes
+	failures  int
+	successes int
+	// ejected is true while the endpoint is removed from the datapath
+	ejected bool
+}
+
+// healthChecker probes the checkpointed endpoints and ejects the failing
+// ones from the datapath. An endpoint is ejected after fall consecutive
+// failed probes and readmitted after rise consecutive successful ones. The
+// last endpoint of an address family is never ejected.
+type healthChecker struct {
+	probe endpointProber
+	fall  int
+	rise  int
+
+	mu        sync.Mutex
+	endpoints []string
+	health    map[string]*endpointHealth
+}
+
+func newHealthChecker(probe endpointProber, fall, rise int) *healthChecker {
+	return &healthChecker{
+		probe:  probe,
+		fall:   fall,
+		rise:   rise,
+		health: map[string]*endpointHealth{},
+	}
+}
+
+// setEndpoints sets the checkpointed endpoints. New endpoints are in the
+// datapath until they fail.
+func (h *healthChecker) setEndpoints(endpoints []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.endpoints = endpoints
+	health := map[string]*endpointHealth{}
+	for _, e := range endpoints {
+		if eh, ok := h.health[e]; ok {
+			health[e] = eh
+		} else {
+			health[e] = &endpointHealth{}
+		}
+	}
+	h.health = health
+}
+
+// rotation returns the endpoints that are not ejected.
+func (h *healthChecker) rotation() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rotationLocked()
+}
+
+func (h *healthChecker) rotationLocked() []string {
+	var eps []string
+	for _, e := range h.endpoints {
+		if !h.health[e].ejected {
+			eps = append(eps, e)
+		}
+	}
+	return eps
+}
+
+// check probes the endpoints concurrently and returns true if an endpoint
+// was ejected or readmitted.
+func (h *healthChecker) check() bool {
+	h.mu.Lock()
+	endpoints := h.endpoints
+	h.mu.Unlock()
+
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func(i int, e string) {
+			defer wg.Done()
+			errs[i] = h.probe(e)
+		}(i, e)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := false
+	for i, e := range endpoints {
+		// skip the endpoints removed while probing
+		if _, ok := h.health[e]; !ok {
+			continue
+		}
+		if h.record(e, errs[i]) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// record records the result of a probe of the given endpoint and returns
+// true if the endpoint was ejected or readmitted.
+func (h *healthChecker) record(endpoint string, err error) bool {
+	eh := h.health[endpoint]
+	if err == nil {
+		eh.failures = 0
+		eh.successes++
+		if eh.ejected && eh.successes >= h.rise {
+			eh.ejected = false
+			log.Printf("etcd endpoint %s is healthy again, readmitting it", endpoint)
+			return true
+		}
+		return false
+	}
+
+	eh.successes = 0
+	eh.failures++
+	if eh.ejected || eh.failures < h.fall {
+		return false
+	}
+	if h.lastOfFamily(endpoint) {
+		log.Printf("etcd endpoint %s is unhealthy, keeping it as the last endpoint of its family: %v", endpoint, err)
+		return false
+	}
+	eh.ejected = true
+	log.Printf("etcd endpoint %s is unhealthy, ejecting it: %v", endpoint, err)
+	return true
+}
+
+// lastOfFamily returns true if the given endpoint is the only endpoint of
+// its address family in the datapath.
+func (h *healthChecker) lastOfFamily(endpoint string) bool {
+	eps4, eps6 := splitEndpointsByFamily(h.rotationLocked())
+	_, ipv6 := splitEndpointsByFamily([]string{endpoint})
+	if len(ipv6) > 0 {
+		return len(eps6) <= 1
+	}
+	return len(eps4) <= 1
+}
+
+// validateHealthCheck returns an error if the given health check settings
+// are invalid.
+func validateHealthCheck(interval, timeout time.Duration, fall, rise int) error {
+	switch {
+	case interval < 0:
+		return fmt.Errorf("interval must not be negative")
+	case timeout <= 0:
+		return fmt.Errorf("timeout must be positive")
+	case fall < 1:
+		return fmt.Errorf("fall must be at least 1")
+	case rise < 1:
+		return fmt.Errorf("rise must be at least 1")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	utiletcd "github.com/coreos/kenc/pkg/util/etcd"
+)
+
+// fakeProber fails the probes of the endpoints marked down.
+type fakeProber struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (p *fakeProber) set(endpoint string, down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down[endpoint] = down
+}
+
+func (p *fakeProber) probe(endpoint string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down[endpoint] {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestHealthCheckerHysteresis(t *testing.T) {
+	p := &fakeProber{down: map[string]bool{}}
+	h := newHealthChecker(p.probe, 2, 2)
+	eps := []string{"10.2.0.5:2379", "10.2.1.7:2379", "10.2.2.9:2379"}
+	h.setEndpoints(eps)
+
+	p.set(eps[1], true)
+	if h.check() {
+		t.Error("expected no ejection before fall failures")
+	}
+	if !h.check() {
+		t.Error("expected an ejection after fall failures")
+	}
+	want := []string{eps[0], eps[2]}
+	if got := h.rotation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", want, got)
+	}
+
+	// a single success does not readmit a flapping endpoint
+	p.set(eps[1], false)
+	if h.check() {
+		t.Error("expected no readmission before rise successes")
+	}
+	p.set(eps[1], true)
+	h.check()
+	p.set(eps[1], false)
+	if h.check() {
+		t.Error("expected the failure to reset the successes")
+	}
+	if !h.check() {
+		t.Error("expected a readmission after rise successes")
+	}
+	if got := h.rotation(); !reflect.DeepEqual(got, eps) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", eps, got)
+	}
+}
+
+func TestHealthCheckerKeepsLastEndpoint(t *testing.T) {
+	p := &fakeProber{down: map[string]bool{}}
+	h := newHealthChecker(p.probe, 1, 1)
+	eps := []string{"10.2.0.5:2379", "10.2.1.7:2379", "[fd00::5]:2379"}
+	h.setEndpoints(eps)
+
+	for _, e := range eps {
+		p.set(e, true)
+	}
+	if !h.check() {
+		t.Error("expected an ejection")
+	}
+	// one endpoint of each family is kept
+	want := []string{eps[1], eps[2]}
+	if got := h.rotation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", want, got)
+	}
+
+	// the ejected endpoint is readmitted, the kept one can be ejected
+	p.set(eps[0], false)
+	if !h.check() {
+		t.Error("expected changes")
+	}
+	want = []string{eps[0], eps[2]}
+	if got := h.rotation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", want, got)
+	}
+}
+
+func TestHealthCheckerSetEndpoints(t *testing.T) {
+	p := &fakeProber{down: map[string]bool{}}
+	h := newHealthChecker(p.probe, 1, 1)
+	eps := []string{"10.2.0.5:2379", "10.2.1.7:2379"}
+	h.setEndpoints(eps)
+	p.set(eps[0], true)
+	h.check()
+
+	// the ejection survives a checkpoint, new endpoints are in rotation
+	h.setEndpoints(append(eps, "10.2.2.9:2379"))
+	want := []string{eps[1], "10.2.2.9:2379"}
+	if got := h.rotation(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", want, got)
+	}
+
+	// a removed endpoint is forgotten
+	h.setEndpoints(eps[1:])
+	h.setEndpoints(eps)
+	if got := h.rotation(); !reflect.DeepEqual(got, eps) {
+		t.Errorf("got wrong rotation, want=%v, got=%v", eps, got)
+	}
+}
+
+func TestEndpointProber(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	probe := newEndpointProber(time.Second, false, utiletcd.TLSFiles{})
+	if err = probe(addr); err != nil {
+		t.Errorf("expected a healthy endpoint, got %v", err)
+	}
+
+	l.Close()
+	if err = probe(addr); err == nil {
+		t.Error("expected failure of a closed endpoint")
+	}
+}
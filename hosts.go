@@ -1,62 +1,65 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
-	"path/filepath"
+	"path"
+	"sort"
+	"strings"
 	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 )
 
 const (
 	etcdDir           = "/var/etcd"
 	etcdHostsFilename = "etcd-hosts.checkpoint"
+
+	defaultHostsInterval = 10 * time.Second
+	defaultClusterDomain = "cluster.local"
+
+	defaultPeerPort   = 2380
+	defaultClientPort = 2379
+
+	// the SRV services of etcd discovery
+	srvServer = "_etcd-server._tcp"
+	srvClient = "_etcd-client._tcp"
+
+	// the markers of the kenc managed block of a hosts file
+	hostsBlockBegin = "# BEGIN kenc managed etcd hosts, do not edit"
+	hostsBlockEnd   = "# END kenc managed etcd hosts"
 )
 
+// etcdSRVServices are the SRV services of the etcd service.
+var etcdSRVServices = []string{srvServer, srvClient}
+
+// hostInfo is an etcd member, its addresses and ports.
 type hostInfo struct {
-	HostName string
-	IP       string
+	HostName   string
+	IPs        []string
+	PeerPort   int
+	ClientPort int
 }
 
-func runHostsCheckpointer(kubecli kubernetes.Interface) {
-	ticker := time.NewTicker(10 * time.Second)
-	for {
-		select {
-		case <-ticker.C:
-			hosts, err := getHosts(kubecli)
-			if err != nil {
-				log.Printf("failed to checkpoint etcd hosts: %v", err)
-				continue
-			}
-			if len(hosts) == 0 {
-				continue
-			}
-			fp := filepath.Join(etcdDir, etcdHostsFilename)
-			err = saveHostsCheckpoint(fp, hosts)
-			if err != nil {
-				log.Printf("failed to update etcd hosts file (%s): %v", fp, err)
-			}
-		}
+// port returns the port of the given SRV service.
+func (h *hostInfo) port(service string) int {
+	if service == srvServer {
+		return h.PeerPort
 	}
+	return h.ClientPort
 }
 
-func getHosts(kubecli kubernetes.Interface) ([]*hostInfo, error) {
-	ls := map[string]string{
-		cluterLabel: clusterName,
-		appLabel:    appName,
-	}
-
+func getHosts(kubecli kubernetes.Interface, selector string) ([]*hostInfo, error) {
 	// TODO: use client side cache
-	lo := metav1.ListOptions{LabelSelector: labels.SelectorFromSet(ls).String()}
-	podList, err := kubecli.Core().Pods(api.NamespaceSystem).List(lo)
+	lo := metav1.ListOptions{LabelSelector: selector}
+	podList, err := kubecli.Core().Pods(etcdNamespace).List(lo)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list running self hosted etcd pods: %v", err)
 	}
@@ -64,27 +67,110 @@ func getHosts(kubecli kubernetes.Interface) ([]*hostInfo, error) {
 	var hs []*hostInfo
 	for i := range podList.Items {
 		pod := &podList.Items[i]
+		if pod.Status.Phase != v1.PodRunning {
+			continue
+		}
 
-		switch pod.Status.Phase {
-		case v1.PodRunning:
-			h := &hostInfo{
-				HostName: pod.Name,
-				IP:       pod.Status.PodIP,
+		var node *v1.Node
+		if pod.Spec.HostNetwork {
+			node, err = kubecli.Core().Nodes().Get(pod.Spec.NodeName, metav1.GetOptions{})
+			if err != nil {
+				// the pod ip is the primary address of the node
+				log.Printf("failed to get the node of etcd pod %s, using its pod ip: %v", pod.Name, err)
+				node = nil
 			}
+		}
+		if h := newHostInfo(pod, node); h != nil {
 			hs = append(hs, h)
 		}
 	}
+	sort.Sort(hostInfosByName(hs))
 	return hs, nil
 }
 
-func saveHostsCheckpoint(filepath string, hosts []*hostInfo) error {
-	f, err := ioutil.TempFile(etcdDir, "tmp-etcd-hosts")
+// newHostInfo returns the host of the given running etcd pod, or nil if it
+// has no address yet. A hostNetwork pod is named after its node, which may be
+// a dotted name such as ip-10-0-0-1.ec2.internal, and has the internal
+// addresses of the given node, if any, else its pod ip. The ports are the
+// container ports named peer (or server) and client, if any.
+func newHostInfo(pod *v1.Pod, node *v1.Node) *hostInfo {
+	h := &hostInfo{
+		HostName:   pod.Name,
+		PeerPort:   defaultPeerPort,
+		ClientPort: etcdClientPort,
+	}
+	for _, c := range pod.Spec.Containers {
+		for _, p := range c.Ports {
+			switch p.Name {
+			case "peer", "server":
+				h.PeerPort = int(p.ContainerPort)
+			case "client":
+				h.ClientPort = int(p.ContainerPort)
+			}
+		}
+	}
+	if pod.Spec.HostNetwork {
+		h.HostName = pod.Spec.NodeName
+		if node != nil {
+			for _, addr := range node.Status.Addresses {
+				if addr.Type == v1.NodeInternalIP && net.ParseIP(addr.Address) != nil {
+					h.IPs = append(h.IPs, addr.Address)
+				}
+			}
+		}
+	}
+	if len(h.IPs) == 0 && len(pod.Status.PodIP) > 0 {
+		h.IPs = []string{pod.Status.PodIP}
+	}
+	if len(h.HostName) == 0 || len(h.IPs) == 0 {
+		return nil
+	}
+	return h
+}
+
+type hostInfosByName []*hostInfo
+
+func (hs hostInfosByName) Len() int { return len(hs) }
+func (hs hostInfosByName) Less(i, j int) bool {
+	if hs[i].HostName != hs[j].HostName {
+		return hs[i].HostName < hs[j].HostName
+	}
+	return len(hs[j].IPs) > 0 && (len(hs[i].IPs) == 0 || hs[i].IPs[0] < hs[j].IPs[0])
+}
+func (hs hostInfosByName) Swap(i, j int) { hs[i], hs[j] = hs[j], hs[i] }
+
+// serviceNames returns the names of the etcd service in the given cluster
+// domain, the fully qualified name first, followed by the names relative to
+// the search domains of the pods.
+func serviceNames(domain string) []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc.%s", etcdService, etcdNamespace, domain),
+		fmt.Sprintf("%s.%s.svc", etcdService, etcdNamespace),
+		fmt.Sprintf("%s.%s", etcdService, etcdNamespace),
+		etcdService,
+	}
+}
+
+// hostNames returns the names of the given etcd member in the given cluster
+// domain, in the order of serviceNames.
+func hostNames(hostName, domain string) []string {
+	var names []string
+	for _, name := range serviceNames(domain) {
+		names = append(names, hostName+"."+name)
+	}
+	return names
+}
+
+// saveHostsCheckpoint atomically writes the host entries of the given hosts
+// in the given cluster domain to filepath.
+func saveHostsCheckpoint(filepath string, hosts []*hostInfo, domain string) error {
+	f, err := ioutil.TempFile(path.Dir(filepath), "tmp-etcd-hosts")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(f.Name())
 
-	b := getHostsBytes(hosts)
+	b := getHostsBytes(hosts, domain)
 	if _, err := f.Write(b); err != nil {
 		return err
 	}
@@ -97,10 +183,142 @@ func saveHostsCheckpoint(filepath string, hosts []*hostInfo) error {
 	return os.Rename(f.Name(), filepath)
 }
 
-func getHostsBytes(hosts []*hostInfo) []byte {
+// getHostsBytes returns the hosts file entries of the given hosts, one line
+// per address resolving the names of hostNames.
+func getHostsBytes(hosts []*hostInfo, domain string) []byte {
 	var buf bytes.Buffer
 	for _, h := range hosts {
-		buf.WriteString(fmt.Sprintf("%s %s.%s.%s.svc.cluster.local\n", h.IP, h.HostName, clusterName, api.NamespaceSystem))
+		names := strings.Join(hostNames(h.HostName, domain), " ")
+		for _, ip := range h.IPs {
+			buf.WriteString(fmt.Sprintf("%s %s\n", ip, names))
+		}
 	}
 	return buf.Bytes()
 }
+
+// getSRVZoneBytes returns a zone file fragment with the etcd SRV records of
+// the given hosts and the address records of their targets. All names are
+// fully qualified, the fragment can be included in any zone.
+func getSRVZoneBytes(hosts []*hostInfo, domain string) []byte {
+	zone := serviceNames(domain)[0] + "."
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "; etcd SRV records of %s, generated by kenc\n", zone)
+	for _, service := range etcdSRVServices {
+		for _, h := range hosts {
+			fmt.Fprintf(&buf, "%s.%s %d IN SRV 0 %d %d %s.\n", service, zone, dnsTTL, dnsSRVWeight, h.port(service), hostNames(h.HostName, domain)[0])
+		}
+	}
+	for _, h := range hosts {
+		for _, ip := range h.IPs {
+			rrtype := "A"
+			if net.ParseIP(ip).To4() == nil {
+				rrtype = "AAAA"
+			}
+			fmt.Fprintf(&buf, "%s. %d IN %s %s\n", hostNames(h.HostName, domain)[0], dnsTTL, rrtype, ip)
+		}
+	}
+	return buf.Bytes()
+}
+
+// hostsCheckpointLines returns the fields of the host entries of the given
+// hosts checkpoint, an address followed by its names. If managedBlock is
+// true, only the entries of the kenc managed block are returned.
+func hostsCheckpointLines(b []byte, managedBlock bool) [][]string {
+	var lines [][]string
+	inBlock := !managedBlock
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case managedBlock && line == hostsBlockBegin:
+			inBlock = true
+			continue
+		case managedBlock && line == hostsBlockEnd:
+			inBlock = false
+			continue
+		case !inBlock || len(line) == 0 || line[0] == '#':
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			continue
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+// saveHostsBlock atomically replaces the kenc managed block of the hosts file
+// at filepath with the host entries of the given hosts, keeping the lines
+// outside of the block. The block is appended if the file has none, the file
+// is created if it does not exist.
+func saveHostsBlock(filepath string, hosts []*hostInfo, domain string) error {
+	var perm os.FileMode = 0644
+	orig, err := ioutil.ReadFile(filepath)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		fi, err := os.Stat(filepath)
+		if err != nil {
+			return err
+		}
+		perm = fi.Mode().Perm()
+	}
+
+	b, err := replaceHostsBlock(orig, getHostsBytes(hosts, domain))
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(b, orig) {
+		return nil
+	}
+	return writeFileAtomicMode(path.Dir(filepath), path.Base(filepath), b, perm)
+}
+
+// replaceHostsBlock returns the given hosts file with the content of its kenc
+// managed block replaced by the given entries, or the block appended if the
+// file has none.
+func replaceHostsBlock(hostsFile, entries []byte) ([]byte, error) {
+	var block bytes.Buffer
+	block.WriteString(hostsBlockBegin + "\n")
+	block.Write(entries)
+	block.WriteString(hostsBlockEnd + "\n")
+
+	lines := strings.SplitAfter(string(hostsFile), "\n")
+	begin, end := -1, -1
+	for i, l := range lines {
+		switch strings.TrimSpace(l) {
+		case hostsBlockBegin:
+			if begin >= 0 {
+				return nil, fmt.Errorf("line %d: duplicate kenc block begin marker", i+1)
+			}
+			begin = i
+		case hostsBlockEnd:
+			if begin < 0 || end >= 0 {
+				return nil, fmt.Errorf("line %d: unexpected kenc block end marker", i+1)
+			}
+			end = i
+		}
+	}
+	if begin >= 0 && end < 0 {
+		return nil, fmt.Errorf("line %d: kenc block begin marker without end marker", begin+1)
+	}
+
+	var buf bytes.Buffer
+	if begin < 0 {
+		buf.Write(hostsFile)
+		if len(hostsFile) > 0 && hostsFile[len(hostsFile)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+		buf.Write(block.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	buf.WriteString(strings.Join(lines[:begin], ""))
+	buf.Write(block.Bytes())
+	buf.WriteString(strings.Join(lines[end+1:], ""))
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+var exampleHosts = []*hostInfo{
+	{HostName: "kube-etcd-0000", IPs: []string{"10.2.0.5"}, PeerPort: 2380, ClientPort: 2379},
+	{HostName: "node-1", IPs: []string{"172.17.4.101", "fd00::101"}, PeerPort: 12380, ClientPort: 12379},
+}
+
+func TestGetHostsBytes(t *testing.T) {
+	want := `10.2.0.5 kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local kube-etcd-0000.kube-etcd.kube-system.svc kube-etcd-0000.kube-etcd.kube-system kube-etcd-0000.kube-etcd
+172.17.4.101 node-1.kube-etcd.kube-system.svc.cluster.local node-1.kube-etcd.kube-system.svc node-1.kube-etcd.kube-system node-1.kube-etcd
+fd00::101 node-1.kube-etcd.kube-system.svc.cluster.local node-1.kube-etcd.kube-system.svc node-1.kube-etcd.kube-system node-1.kube-etcd
+`
+	got := string(getHostsBytes(exampleHosts, defaultClusterDomain))
+	if got != want {
+		t.Error("got wrong hosts bytes")
+		t.Errorf("want: %s", want)
+		t.Errorf("got: %s", got)
+	}
+
+	want = "10.2.0.5 kube-etcd-0000.kube-etcd.kube-system.svc.example.org kube-etcd-0000.kube-etcd.kube-system.svc kube-etcd-0000.kube-etcd.kube-system kube-etcd-0000.kube-etcd\n"
+	got = string(getHostsBytes(exampleHosts[:1], "example.org"))
+	if got != want {
+		t.Errorf("got wrong hosts bytes for custom domain, want=%q, got=%q", want, got)
+	}
+
+	if got := getHostsBytes(nil, defaultClusterDomain); len(got) != 0 {
+		t.Errorf("expected no hosts, got %q", got)
+	}
+}
+
+func TestNewHostInfo(t *testing.T) {
+	node := &v1.Node{
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "203.0.113.1"},
+				{Type: v1.NodeInternalIP, Address: "172.17.4.101"},
+				{Type: v1.NodeHostName, Address: "node-1"},
+				{Type: v1.NodeInternalIP, Address: "fd00::101"},
+			},
+		},
+	}
+
+	tests := []struct {
+		pod  *v1.Pod
+		node *v1.Node
+		want *hostInfo
+	}{
+		{
+			pod:  &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0000"}, Status: v1.PodStatus{PodIP: "10.2.0.5"}},
+			want: &hostInfo{HostName: "kube-etcd-0000", IPs: []string{"10.2.0.5"}, PeerPort: 2380, ClientPort: 2379},
+		},
+		{
+			pod:  &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0000"}, Status: v1.PodStatus{PodIP: "fd00:10:2::5"}},
+			want: &hostInfo{HostName: "kube-etcd-0000", IPs: []string{"fd00:10:2::5"}, PeerPort: 2380, ClientPort: 2379},
+		},
+		{
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0001"},
+				Spec: v1.PodSpec{
+					HostNetwork: true,
+					NodeName:    "node-1",
+					Containers: []v1.Container{{
+						Name: "etcd",
+						Ports: []v1.ContainerPort{
+							{Name: "client", ContainerPort: 12379},
+							{Name: "peer", ContainerPort: 12380},
+						},
+					}},
+				},
+				Status: v1.PodStatus{PodIP: "172.17.4.101"},
+			},
+			node: node,
+			want: &hostInfo{HostName: "node-1", IPs: []string{"172.17.4.101", "fd00::101"}, PeerPort: 12380, ClientPort: 12379},
+		},
+		{
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0001"},
+				Spec:       v1.PodSpec{HostNetwork: true, NodeName: "node-1"},
+				Status:     v1.PodStatus{PodIP: "172.17.4.101"},
+			},
+			want: &hostInfo{HostName: "node-1", IPs: []string{"172.17.4.101"}, PeerPort: 2380, ClientPort: 2379},
+		},
+		{
+			// node names are often fully qualified
+			pod: &v1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0001"},
+				Spec:       v1.PodSpec{HostNetwork: true, NodeName: "ip-10-0-0-1.ec2.internal"},
+				Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+			},
+			want: &hostInfo{HostName: "ip-10-0-0-1.ec2.internal", IPs: []string{"10.0.0.1"}, PeerPort: 2380, ClientPort: 2379},
+		},
+		{
+			pod: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "kube-etcd-0002"}},
+		},
+	}
+	for i, tt := range tests {
+		got := newHostInfo(tt.pod, tt.node)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("#%d: got wrong host, want=%+v, got=%+v", i, tt.want, got)
+		}
+	}
+}
+
+func TestGetSRVZoneBytes(t *testing.T) {
+	want := `; etcd SRV records of kube-etcd.kube-system.svc.cluster.local., generated by kenc
+_etcd-server._tcp.kube-etcd.kube-system.svc.cluster.local. 5 IN SRV 0 10 2380 kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.
+_etcd-server._tcp.kube-etcd.kube-system.svc.cluster.local. 5 IN SRV 0 10 12380 node-1.kube-etcd.kube-system.svc.cluster.local.
+_etcd-client._tcp.kube-etcd.kube-system.svc.cluster.local. 5 IN SRV 0 10 2379 kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.
+_etcd-client._tcp.kube-etcd.kube-system.svc.cluster.local. 5 IN SRV 0 10 12379 node-1.kube-etcd.kube-system.svc.cluster.local.
+kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local. 5 IN A 10.2.0.5
+node-1.kube-etcd.kube-system.svc.cluster.local. 5 IN A 172.17.4.101
+node-1.kube-etcd.kube-system.svc.cluster.local. 5 IN AAAA fd00::101
+`
+	got := string(getSRVZoneBytes(exampleHosts, defaultClusterDomain))
+	if got != want {
+		t.Error("got wrong SRV zone")
+		t.Errorf("want: %s", want)
+		t.Errorf("got: %s", got)
+	}
+}
+
+func TestSaveHostsCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fp := path.Join(dir, etcdHostsFilename)
+	if err = ioutil.WriteFile(fp, []byte("10.2.9.9 stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = saveHostsCheckpoint(fp, exampleHosts, defaultClusterDomain); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := string(getHostsBytes(exampleHosts, defaultClusterDomain)); string(b) != want {
+		t.Errorf("got wrong checkpoint, want=%q, got=%q", want, b)
+	}
+
+	// the temporary file is written next to the checkpoint and removed
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 {
+		t.Errorf("expected only the checkpoint in %s, got %d files", dir, len(fis))
+	}
+
+	if err = saveHostsCheckpoint(path.Join(dir, "missing", etcdHostsFilename), exampleHosts, defaultClusterDomain); err == nil {
+		t.Error("expected failure for a missing directory")
+	}
+}
+
+func TestReplaceHostsBlock(t *testing.T) {
+	entries := getHostsBytes(exampleHosts[:1], defaultClusterDomain)
+	block := hostsBlockBegin + "\n" + string(entries) + hostsBlockEnd + "\n"
+
+	tests := []struct {
+		hosts string
+		want  string
+	}{
+		{"", block},
+		{"127.0.0.1 localhost\n", "127.0.0.1 localhost\n" + block},
+		{"127.0.0.1 localhost", "127.0.0.1 localhost\n" + block},
+		{
+			"127.0.0.1 localhost\n" + hostsBlockBegin + "\n10.2.9.9 stale\n" + hostsBlockEnd + "\n::1 localhost\n",
+			"127.0.0.1 localhost\n" + block + "::1 localhost\n",
+		},
+		{"127.0.0.1 localhost\n" + hostsBlockBegin + "\n" + hostsBlockEnd, "127.0.0.1 localhost\n" + block},
+	}
+	for i, tt := range tests {
+		got, err := replaceHostsBlock([]byte(tt.hosts), entries)
+		if err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("#%d: got wrong hosts file, want=%q, got=%q", i, tt.want, got)
+		}
+	}
+
+	for _, hosts := range []string{
+		hostsBlockBegin + "\n10.2.9.9 stale\n",
+		hostsBlockEnd + "\n",
+		hostsBlockBegin + "\n" + hostsBlockBegin + "\n" + hostsBlockEnd + "\n",
+		hostsBlockBegin + "\n" + hostsBlockEnd + "\n" + hostsBlockEnd + "\n",
+	} {
+		if _, err := replaceHostsBlock([]byte(hosts), entries); err == nil {
+			t.Errorf("expected failure for %q", hosts)
+		}
+	}
+}
+
+func TestSaveHostsBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fp := path.Join(dir, "hosts")
+	orig := "127.0.0.1 localhost\n"
+	if err = ioutil.WriteFile(fp, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hosts := range [][]*hostInfo{exampleHosts, exampleHosts[1:]} {
+		if err = saveHostsBlock(fp, hosts, defaultClusterDomain); err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := orig + hostsBlockBegin + "\n" + string(getHostsBytes(hosts, defaultClusterDomain)) + hostsBlockEnd + "\n"
+		if string(b) != want {
+			t.Errorf("got wrong hosts file, want=%q, got=%q", want, b)
+		}
+	}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0644 {
+		t.Errorf("expected the permissions to be kept, got %v", fi.Mode())
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	utilipset "github.com/coreos/kenc/pkg/util/ipset"
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+const (
+	// the ipsets holding the checkpointed etcd endpoints
+	etcdEndpointsSet  = "KENC-ETCD-EP"
+	etcdEndpointsSet6 = "KENC-ETCD-EP6"
+)
+
+// endpointsSetName returns the name of the endpoints set for the given address family.
+func endpointsSetName(ipv6 bool) string {
+	if ipv6 {
+		return etcdEndpointsSet6
+	}
+	return etcdEndpointsSet
+}
+
+// endpointsSetBytes returns the `ipset restore` payload that replaces the
+// members of the given set with the given endpoints. The new members are
+// added to a temporary set first, which is then swapped with the given set,
+// so that the set is never seen partially updated.
+func endpointsSetBytes(set string, ipv6 bool, endpoints []string) ([]byte, error) {
+	family := "inet"
+	if ipv6 {
+		family = "inet6"
+	}
+	tmp := set + "-TMP"
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "create %s hash:ip,port family %s -exist\n", set, family)
+	fmt.Fprintf(&buf, "create %s hash:ip,port family %s -exist\n", tmp, family)
+	fmt.Fprintf(&buf, "flush %s\n", tmp)
+	for _, e := range endpoints {
+		host, port, err := net.SplitHostPort(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %v", e, err)
+		}
+		fmt.Fprintf(&buf, "add %s %s,tcp:%s\n", tmp, host, port)
+	}
+	fmt.Fprintf(&buf, "swap %s %s\n", tmp, set)
+	fmt.Fprintf(&buf, "destroy %s\n", tmp)
+
+	return buf.Bytes(), nil
+}
+
+// getEndpointsFromSetSave returns the sorted endpoints of the given set from
+// its `ipset save` output.
+func getEndpointsFromSetSave(set string, save []byte) ([]string, error) {
+	var eps []string
+	for _, line := range strings.Split(string(save), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != set {
+			continue
+		}
+
+		// members are formatted as "<ip>,tcp:<port>"
+		parts := strings.SplitN(fields[2], ",", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "tcp:") {
+			return nil, fmt.Errorf("unexpected ipset member: %v", fields[2])
+		}
+		eps = append(eps, net.JoinHostPort(parts[0], strings.TrimPrefix(parts[1], "tcp:")))
+	}
+	sort.Strings(eps)
+	return eps, nil
+}
+
+// swapEndpointsSet replaces the members of the endpoints set with the given
+// endpoints. It returns true if the members changed.
+func swapEndpointsSet(ipset utilipset.Interface, ipv6 bool, endpoints []string) (bool, error) {
+	set := endpointsSetName(ipv6)
+
+	var before []string
+	// the set does not exist on the first sync
+	if save, err := ipset.Save(set); err == nil {
+		before, err = getEndpointsFromSetSave(set, save)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	b, err := endpointsSetBytes(set, ipv6, endpoints)
+	if err != nil {
+		return false, err
+	}
+	if err = ipset.Restore(b); err != nil {
+		return false, err
+	}
+
+	after := append([]string(nil), endpoints...)
+	sort.Strings(after)
+	return strings.Join(before, ",") != strings.Join(after, ","), nil
+}
+
+// getNatChainBytes returns the `iptables-restore --noflush` payload that
+// replaces the rules of the SELF-HOSTED-ETCD chain with rules forwarding
+// the packets to one of the given endpoints randomly.
+func getNatChainBytes(endpoints []string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s\n", utiliptables.TableNAT)
+	fmt.Fprintf(&buf, "%s\n", utiliptables.MakeChainLine(selfHostedetcdChain))
+
+	n := len(endpoints)
+	for i, e := range endpoints {
+		// the rule for the i-th endpoint is reached with probability
+		// (n-i)/n, so it matches with probability 1/(n-i).
+		args := natTableRuleArgs(e, 1.0/float64(n-i))
+		fmt.Fprintf(&buf, "-A %s %s\n", selfHostedetcdChain, strings.Join(args, " "))
+	}
+	fmt.Fprintf(&buf, "COMMIT\n")
+
+	return buf.Bytes()
+}
+
+// getNatChainEndpoints returns the DNAT destinations of the rules of the
+// SELF-HOSTED-ETCD chain in the given iptables-save data, in rule order.
+func getNatChainEndpoints(save []byte) ([]string, error) {
+	t, err := parseTable(utiliptables.TableNAT, save)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	var eps []string
+	for _, r := range t.rules {
+		if r.chain == selfHostedetcdChain {
+			eps = append(eps, r.argValue("--to-destination"))
+		}
+	}
+	return eps, nil
+}
+
+// writeNatTableRuleFromSet swaps the given endpoints into the endpoints set
+// and, if the members changed or the live SELF-HOSTED-ETCD chain does not
+// forward to them, e.g. after it was flushed, replaces the rules of the
+// chain in a single iptables-restore transaction.
+// It returns true if the chain was written.
+// This is used to implement etcd endpoints level checkpoint.
+func writeNatTableRuleFromSet(ipt utiliptables.Interface, ipset utilipset.Interface, endpoints []string) (bool, error) {
+	changed, err := swapEndpointsSet(ipset, ipt.IsIpv6(), endpoints)
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		save, err := ipt.Save(utiliptables.TableNAT)
+		if err != nil {
+			return false, err
+		}
+		live, err := getNatChainEndpoints(save)
+		if err != nil {
+			return false, err
+		}
+		if strings.Join(live, ",") == strings.Join(endpoints, ",") {
+			return false, nil
+		}
+	}
+
+	// declaring the chain flushes it, other chains are kept
+	err = ipt.Restore(utiliptables.TableNAT, getNatChainBytes(endpoints), utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	utildbus "github.com/coreos/kenc/pkg/util/dbus"
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+func TestEndpointsSetBytes(t *testing.T) {
+	got, err := endpointsSetBytes(etcdEndpointsSet6, true, []string{"[fd00::4]:2379", "[fd00::5]:2379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `create KENC-ETCD-EP6 hash:ip,port family inet6 -exist
+create KENC-ETCD-EP6-TMP hash:ip,port family inet6 -exist
+flush KENC-ETCD-EP6-TMP
+add KENC-ETCD-EP6-TMP fd00::4,tcp:2379
+add KENC-ETCD-EP6-TMP fd00::5,tcp:2379
+swap KENC-ETCD-EP6-TMP KENC-ETCD-EP6
+destroy KENC-ETCD-EP6-TMP
+`
+	if string(got) != want {
+		t.Error("got wrong ipset payload")
+		t.Error(want)
+		t.Error(string(got))
+	}
+}
+
+func TestGetEndpointsFromSetSave(t *testing.T) {
+	save := []byte(`create KENC-ETCD-EP hash:ip,port family inet hashsize 1024 maxelem 65536
+add KENC-ETCD-EP 10.2.0.5,tcp:2379
+add KENC-ETCD-EP 10.2.0.4,tcp:2379
+`)
+
+	got, err := getEndpointsFromSetSave(etcdEndpointsSet, save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.2.0.4:2379", "10.2.0.5:2379"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestGetNatChainBytes(t *testing.T) {
+	got := getNatChainBytes([]string{"10.2.0.4:2379", "10.2.0.5:2379"})
+
+	want := `*nat
+:SELF-HOSTED-ETCD - [0:0]
+-A SELF-HOSTED-ETCD -p tcp -m tcp -m state --state New -m statistic --mode random --probability 0.50000 -j DNAT --to-destination 10.2.0.4:2379
+-A SELF-HOSTED-ETCD -p tcp -m tcp -m state --state New -m statistic --mode random --probability 1.00000 -j DNAT --to-destination 10.2.0.5:2379
+COMMIT
+`
+	if string(got) != want {
+		t.Error("got wrong chain")
+		t.Error(want)
+		t.Error(string(got))
+	}
+}
+
+func TestGetNatChainEndpoints(t *testing.T) {
+	save := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:SELF-HOSTED-ETCD - [0:0]
+-A PREROUTING -d 10.3.0.15/32 -p tcp -m tcp --dport 2379 -j SELF-HOSTED-ETCD
+-A SELF-HOSTED-ETCD -p tcp -m tcp -m state --state NEW -m statistic --mode random --probability 0.50000000000 -j DNAT --to-destination 10.2.0.4:2379
+-A SELF-HOSTED-ETCD -p tcp -m tcp -m state --state NEW -m statistic --mode random --probability 1.00000000000 -j DNAT --to-destination 10.2.0.5:2379
+COMMIT
+`)
+
+	got, err := getNatChainEndpoints(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.2.0.4:2379", "10.2.0.5:2379"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+type fakeIPSet struct {
+	save     []byte
+	restored []byte
+}
+
+func (f *fakeIPSet) Save(set string) ([]byte, error) { return f.save, nil }
+
+func (f *fakeIPSet) Restore(data []byte) error {
+	f.restored = data
+	return nil
+}
+
+func TestWriteNatTableRuleFromSetRewritesFlushedChain(t *testing.T) {
+	fcmd := utilexec.FakeCmd{
+		CombinedOutputScript: []utilexec.FakeCombinedOutputAction{
+			// iptables version check
+			func() ([]byte, error) { return []byte("iptables v1.6.1"), nil },
+			// the chain was flushed behind our back
+			func() ([]byte, error) { return []byte("*nat\n:SELF-HOSTED-ETCD - [0:0]\nCOMMIT\n"), nil },
+			func() ([]byte, error) { return []byte{}, nil },
+		},
+	}
+	fexec := utilexec.FakeExec{
+		CommandScript: []utilexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	ipt := utiliptables.New(&fexec, utildbus.NewFake(nil, nil), utiliptables.ProtocolIpv4)
+	defer ipt.Destroy()
+
+	// the members of the set did not change
+	ipset := &fakeIPSet{save: []byte("add KENC-ETCD-EP 10.2.0.4,tcp:2379\n")}
+	written, err := writeNatTableRuleFromSet(ipt, ipset, []string{"10.2.0.4:2379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !written {
+		t.Error("expected the flushed chain to be rewritten")
+	}
+	if fexec.CommandCalls != 3 {
+		t.Errorf("expected 3 commands, got %d", fexec.CommandCalls)
+	}
+}
@@ -1,17 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"os"
-	"path"
+	"log"
+	"net"
+	"strings"
 
 	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
 )
 
 const (
-	iptablesCheckpointFile = "iptables.checkpoint"
+	iptablesCheckpointFile  = "iptables.checkpoint"
+	ip6tablesCheckpointFile = "ip6tables.checkpoint"
 )
 
 var (
@@ -24,15 +26,7 @@ func writeRouteRule(ipt utiliptables.Interface, vip string) error {
 		return err
 	}
 	// ensure the traffic to the vip jumps to our chain
-	args := []string{
-		"-p", "tcp",
-		"--destination", vip,
-		"--destination-port", clientPort,
-		"-m", "tcp",
-		"-m", "state",
-		"--state", "NEW",
-		"-j", string(selfHostedetcdChain),
-	}
+	args := routeRuleArgs(vip)
 
 	_, err = ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, utiliptables.ChainPrerouting, args...)
 	if err != nil {
@@ -46,6 +40,42 @@ func writeRouteRule(ipt utiliptables.Interface, vip string) error {
 	return nil
 }
 
+// deleteRouteRule deletes the rules written by writeRouteRule and the
+// self hosted etcd chain.
+func deleteRouteRule(ipt utiliptables.Interface, vip string) error {
+	args := routeRuleArgs(vip)
+	for _, chain := range []utiliptables.Chain{utiliptables.ChainPrerouting, utiliptables.ChainOutput} {
+		err := ipt.DeleteRule(utiliptables.TableNAT, chain, args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := ipt.FlushChain(utiliptables.TableNAT, selfHostedetcdChain)
+	if err != nil && !utiliptables.IsNotFoundError(err) {
+		return err
+	}
+	err = ipt.DeleteChain(utiliptables.TableNAT, selfHostedetcdChain)
+	if err != nil && !utiliptables.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// routeRuleArgs returns the rule arguments sending new connections to the
+// given vip to the self hosted etcd chain.
+func routeRuleArgs(vip string) []string {
+	return []string{
+		"-p", "tcp",
+		"--destination", vip,
+		"--destination-port", clientPort(),
+		"-m", "tcp",
+		"-m", "state",
+		"--state", "NEW",
+		"-j", string(selfHostedetcdChain),
+	}
+}
+
 // writeNatTableRule writes a iptables NAT rule to forward the
 // packets sent to the given vip to one of the given endpoints
 // randomly.
@@ -58,17 +88,7 @@ func writeNatTableRule(ipt utiliptables.Interface, vip string, endpoints []strin
 
 	n := len(endpoints)
 	for i, e := range endpoints {
-		args := []string{
-			"-p", "tcp", // only change the new connections
-			"-m", "tcp",
-			"-m", "state",
-			"--state", "New",
-			"-m", "statistic",
-			"--mode", "random",
-			"--probability", fmt.Sprintf("%0.5f", 1.0/float64(i+1)),
-			"-j", "DNAT",
-			"--to-destination", e,
-		}
+		args := natTableRuleArgs(e, 1.0/float64(i+1))
 
 		_, err = ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, selfHostedetcdChain, args...)
 		if err != nil {
@@ -88,50 +108,363 @@ func writeNatTableRule(ipt utiliptables.Interface, vip string, endpoints []strin
 	}
 }
 
+// splitEndpointsByFamily splits the given "host:port" endpoints into IPv4
+// and IPv6 endpoints. Endpoints that cannot be parsed are dropped.
+func splitEndpointsByFamily(endpoints []string) (eps4, eps6 []string) {
+	for _, e := range endpoints {
+		host, _, err := net.SplitHostPort(e)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			eps4 = append(eps4, e)
+		default:
+			eps6 = append(eps6, e)
+		}
+	}
+	return eps4, eps6
+}
+
+// natTableRuleArgs returns the rule arguments forwarding new connections to
+// the given endpoint with the given probability.
+func natTableRuleArgs(endpoint string, probability float64) []string {
+	return []string{
+		"-p", "tcp", // only change the new connections
+		"-m", "tcp",
+		"-m", "state",
+		"--state", "New",
+		"-m", "statistic",
+		"--mode", "random",
+		"--probability", fmt.Sprintf("%0.5f", probability),
+		"-j", "DNAT",
+		"--to-destination", endpoint,
+	}
+}
+
 // saveIPtable saves iptables rule related to etcd connectivity into the given file
+// The selected tables are saved one after the other in the same file.
+// If services are selected, only the rules of the selected services are saved.
+// The previous checkpoint is kept if the selected rules are empty or miss the
+// etcd service rule of the given service ip, e.g. while kube-proxy restarts.
 // This is used to implement iptable level checkpoint.
-func saveIPtables(ipt utiliptables.Interface, dir, filename string) error {
+func saveIPtables(ipt utiliptables.Interface, vip string, sel iptablesSelection, dir, filename string) error {
 	b, err := ipt.SaveAll()
 	if err != nil {
 		return err
 	}
 
-	b, err = getKubeNATTableLines(b)
-	if err != nil {
-		return err
+	var checkpoint []byte
+	for _, table := range sel.tables {
+		var lines []byte
+		if len(sel.services) > 0 {
+			lines, err = getSelectedTableLines(table, b, sel.services)
+		} else {
+			lines, err = getKubeTableLines(table, b, sel.patterns)
+		}
+		if err != nil {
+			return fmt.Errorf("%s table: %v", table, err)
+		}
+		checkpoint = append(checkpoint, lines...)
 	}
 
-	f, err := ioutil.TempFile(dir, "tmp-ipt")
+	ok, err := hasEtcdServiceRules(checkpoint, sel.tables, vip)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(f.Name())
-
-	n, err := f.Write(b)
-	if err == nil && n < len(b) {
-		return io.ErrShortWrite
-	}
-	if err != nil {
-		return err
+	if !ok {
+		log.Printf("no kube-proxy rules for the etcd service ip %s, keeping the previous checkpoint", vip)
+		return nil
 	}
-	if err := f.Sync(); err != nil {
-		return err
+
+	// keep the previous checkpoint if the new one cannot be restored
+	if err = ipt.ValidateRestoreAll(checkpoint, utiliptables.NoFlushTables); err != nil {
+		return fmt.Errorf("invalid checkpoint: %v", err)
 	}
-	if err := f.Close(); err != nil {
-		return err
+
+	return writeCheckpoint(dir, filename, checkpoint)
+}
+
+// hasEtcdServiceRules returns true if the given checkpoint of the given
+// tables has rules and, if the NAT table is checkpointed, the kube-proxy
+// services rule of the given etcd service ip.
+func hasEtcdServiceRules(checkpoint []byte, tables []utiliptables.Table, vip string) (bool, error) {
+	rules := 0
+	for _, table := range tables {
+		t, err := parseTable(table, checkpoint)
+		if err != nil {
+			return false, err
+		}
+		if t == nil {
+			continue
+		}
+		if table == utiliptables.TableNAT && !isEtcdServiceProgrammed(t, vip) {
+			return false, nil
+		}
+		rules += len(t.rules)
 	}
-	return os.Rename(f.Name(), path.Join(dir, filename))
+	return rules > 0, nil
 }
 
+// iptablesRestorePath is the way restoreIPtablesFromFile recovered the rules.
+type iptablesRestorePath string
+
+const (
+	// the etcd service rules are programmed, nothing was restored
+	iptablesRestoreSkipped iptablesRestorePath = "skipped, etcd service rules present"
+	// all checkpointed chains are present, nothing was restored
+	iptablesRestoreNothing iptablesRestorePath = "skipped, no checkpointed chain missing"
+	// none of the checkpointed chains was present, all were restored
+	iptablesRestoreFull iptablesRestorePath = "restored all checkpointed chains"
+	// only the missing checkpointed chains were restored
+	iptablesRestorePartial iptablesRestorePath = "restored missing checkpointed chains"
+)
+
 // restoreIPtableFromFile restores the iptable configuration from the give file
 // that contains iptable rules.
+// If kube-proxy has already programmed the rules of the etcd service ip, the
+// stale checkpoint is not restored. Otherwise only the checkpointed chains
+// missing from the live tables are restored, together with the checkpointed
+// rules linking the live chains to them.
 // This is used to implement iptable level checkpoint.
-func restoreIPtablesFromFile(ipt utiliptables.Interface, filepath string) error {
+func restoreIPtablesFromFile(ipt utiliptables.Interface, vip string, tables []utiliptables.Table, filepath string) (iptablesRestorePath, error) {
 	b, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	live, err := ipt.SaveAll()
+	if err != nil {
+		return "", err
+	}
+	nat, err := parseTable(utiliptables.TableNAT, live)
+	if err != nil {
+		return "", err
+	}
+	if isEtcdServiceProgrammed(nat, vip) {
+		return iptablesRestoreSkipped, nil
+	}
+
+	var data []byte
+	full := true
+	for _, table := range tables {
+		lines, partial, err := getMissingTableLines(table, b, live)
+		if err != nil {
+			return "", fmt.Errorf("%s table: %v", table, err)
+		}
+		data = append(data, lines...)
+		full = full && !partial
+	}
+	if len(data) == 0 {
+		return iptablesRestoreNothing, nil
+	}
+	data = markRestoredLines(data)
+
+	if err = ipt.ValidateRestoreAll(data, utiliptables.NoFlushTables); err != nil {
+		return "", fmt.Errorf("invalid checkpoint %s: %v", filepath, err)
 	}
 
 	// do not overwrite existing rules, do not restore counters
-	return ipt.RestoreAll(b, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+	if err = ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters); err != nil {
+		return "", err
+	}
+	if full {
+		return iptablesRestoreFull, nil
+	}
+	return iptablesRestorePartial, nil
+}
+
+// kencRestoredComment is the comment of the rules restored from an iptables
+// checkpoint. kube-proxy rewrites its chains without it, which tells its own
+// rules from the restored ones however identical they are otherwise.
+const kencRestoredComment = "kenc-restored"
+
+// markRestoredLines returns the given iptables-restore data with every rule
+// commented with kencRestoredComment.
+func markRestoredLines(data []byte) []byte {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			parts := strings.SplitN(line, " ", 3)
+			if len(parts) == 3 {
+				line = fmt.Sprintf("-A %s -m comment --comment %s %s", parts[1], kencRestoredComment, parts[2])
+			}
+		}
+		buf.WriteString(line)
+	}
+	return buf.Bytes()
+}
+
+// getRestoredRulesRemoval returns the iptables-restore --noflush lines
+// deleting the restored rules left in the given table, and the chains that
+// only held restored rules and that no other rule jumps to.
+func getRestoredRulesRemoval(t *iptablesTable) []byte {
+	if t == nil {
+		return nil
+	}
+
+	var deletes []string
+	restored := make(map[utiliptables.Chain]bool)
+	kept := make(map[utiliptables.Chain]bool)
+	for _, r := range t.rules {
+		if r.isRestored() {
+			deletes = append(deletes, "-D"+strings.TrimPrefix(r.line, "-A"))
+			restored[r.chain] = true
+			continue
+		}
+		kept[r.chain] = true
+		kept[utiliptables.Chain(r.target())] = true
+	}
+	if len(deletes) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%s\n", t.table)
+	for _, line := range deletes {
+		fmt.Fprintf(&buf, "%s\n", line)
+	}
+	for _, c := range t.chains {
+		// built-in chains have a policy
+		builtin := strings.Fields(t.chainLines[c])[1] != "-"
+		if restored[c] && !kept[c] && !builtin {
+			fmt.Fprintf(&buf, "-X %s\n", c)
+		}
+	}
+	fmt.Fprintf(&buf, "COMMIT\n")
+	return buf.Bytes()
+}
+
+// removeRestoredRules deletes the restored rules and chains left in the
+// given tables, see getRestoredRulesRemoval.
+func removeRestoredRules(ipt utiliptables.Interface, tables []utiliptables.Table) error {
+	live, err := ipt.SaveAll()
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	for _, table := range tables {
+		t, err := parseTable(table, live)
+		if err != nil {
+			return fmt.Errorf("%s table: %v", table, err)
+		}
+		data = append(data, getRestoredRulesRemoval(t)...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return ipt.RestoreAll(data, utiliptables.NoFlushTables, utiliptables.NoRestoreCounters)
+}
+
+// isEtcdServiceProgrammed returns true if the given live NAT table has a
+// kube-proxy services rule for the etcd service ip.
+func isEtcdServiceProgrammed(nat *iptablesTable, vip string) bool {
+	_, ok := getEtcdServiceChain(nat, vip)
+	return ok
+}
+
+// getEtcdServiceChain returns the chain the kube-proxy services rule for the
+// etcd service ip jumps to, if the given NAT table has such a rule.
+func getEtcdServiceChain(nat *iptablesTable, vip string) (utiliptables.Chain, bool) {
+	if nat == nil {
+		return "", false
+	}
+	for _, r := range nat.rules {
+		if r.chain != kubeServicesChain || r.argValue("--dport", "--destination-port") != clientPort() {
+			continue
+		}
+		switch r.argValue("-d", "--destination") {
+		case vip, vip + "/32", vip + "/128":
+			c := utiliptables.Chain(r.target())
+			if _, ok := nat.chainLines[c]; ok {
+				return c, true
+			}
+		}
+	}
+	return "", false
+}
+
+// getEtcdServiceEndpoints returns the endpoints the given NAT table forwards
+// the etcd service ip to, following the kube-proxy service chain to the
+// DNAT rules of its endpoint chains.
+func getEtcdServiceEndpoints(nat *iptablesTable, vip string) []string {
+	svc, ok := getEtcdServiceChain(nat, vip)
+	if !ok {
+		return nil
+	}
+
+	seps := nat.closure([]utiliptables.Chain{svc})
+	var endpoints []string
+	for _, r := range nat.rules {
+		if !seps[r.chain] || r.target() != "DNAT" {
+			continue
+		}
+		if ep := r.argValue("--to-destination"); len(ep) > 0 {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// getMissingTableLines returns the lines of the given table in the
+// checkpoint restoring the chains missing from the live rules: the missing
+// chains with their rules, and the rules of the live chains jumping to
+// them. It also returns whether some of the checkpointed chains are live.
+// Empty live chains, e.g. the ones ensured by ensureLinkingChains before
+// kube-proxy synced, count as missing. Rules are not restored into the other
+// live chains unless they jump to an absent chain, as kube-proxy owns them.
+func getMissingTableLines(table utiliptables.Table, checkpoint, live []byte) ([]byte, bool, error) {
+	ct, err := parseTable(table, checkpoint)
+	if err != nil || ct == nil {
+		return nil, false, err
+	}
+	lt, err := parseTable(table, live)
+	if err != nil {
+		return nil, false, err
+	}
+
+	liveChains := map[utiliptables.Chain]bool{}
+	nonEmpty := map[utiliptables.Chain]bool{}
+	if lt != nil {
+		for _, c := range lt.chains {
+			liveChains[c] = true
+		}
+		for _, r := range lt.rules {
+			nonEmpty[r.chain] = true
+		}
+	}
+
+	missing := map[utiliptables.Chain]bool{}
+	for _, c := range ct.chains {
+		if !nonEmpty[c] {
+			missing[c] = true
+		}
+	}
+	partial := len(missing) < len(ct.chains)
+	if len(missing) == 0 {
+		return nil, partial, nil
+	}
+
+	var rules []iptablesRule
+	for _, r := range ct.rules {
+		target := utiliptables.Chain(r.target())
+		if missing[r.chain] || (liveChains[r.chain] && missing[target] && !liveChains[target]) {
+			rules = append(rules, r)
+		}
+	}
+
+	chains := map[utiliptables.Chain]bool{}
+	for c := range liveChains {
+		chains[c] = true
+	}
+	for c := range missing {
+		chains[c] = true
+	}
+	if err = validate(chains, rules); err != nil {
+		return nil, partial, err
+	}
+	return ct.bytes(missing, rules), partial, nil
 }
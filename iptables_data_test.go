@@ -173,3 +173,165 @@ var wantTables = []byte(`*nat
 -A KUBE-SVC-XP4WJ6VSLGWALMW5 -m comment --comment "kube-system/default-http-backend:http" -j KUBE-SEP-XDKEUXTVGH54XD6T
 COMMIT
 `)
+
+// exampleTablesV124 is the nat table programmed by kube-proxy v1.24 for a
+// cluster with a self hosted etcd and a NodePort service.
+var exampleTablesV124 = []byte(`# Generated by iptables-save v1.8.7 on Mon Jun 20 10:12:41 2022
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:CNI-HOSTPORT-DNAT - [0:0]
+:KUBE-EXT-GNZBNJ2PO5MGZ6GT - [0:0]
+:KUBE-KUBELET-CANARY - [0:0]
+:KUBE-MARK-DROP - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-NODEPORTS - [0:0]
+:KUBE-POSTROUTING - [0:0]
+:KUBE-PROXY-CANARY - [0:0]
+:KUBE-SEP-2ZTR26TO4XFPTOIT - [0:0]
+:KUBE-SEP-6E7XQMQ4RAYOWTTM - [0:0]
+:KUBE-SEP-N4G2XR5TDX7PQE7P - [0:0]
+:KUBE-SEP-YIL6JZP7A3QYXJU2 - [0:0]
+:KUBE-SEP-ZP3FB6NMPNCO4VBJ - [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-ERIFXISQEP7F7OF4 - [0:0]
+:KUBE-SVC-GNZBNJ2PO5MGZ6GT - [0:0]
+:KUBE-SVC-JD5MR3NA4I4DYORP - [0:0]
+:KUBE-SVC-NPX46M4PTMTKRN6Y - [0:0]
+:KUBE-SVC-XGLOHA7QRQ3V22RZ - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A PREROUTING -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A OUTPUT -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -m addrtype --dst-type LOCAL -j CNI-HOSTPORT-DNAT
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+-A KUBE-EXT-GNZBNJ2PO5MGZ6GT -m comment --comment "masquerade traffic for default/web:http external destinations" -j KUBE-MARK-MASQ
+-A KUBE-EXT-GNZBNJ2PO5MGZ6GT -j KUBE-SVC-GNZBNJ2PO5MGZ6GT
+-A KUBE-MARK-DROP -j MARK --set-xmark 0x8000/0x8000
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A KUBE-NODEPORTS -p tcp -m comment --comment "default/web:http" -m tcp --dport 30080 -j KUBE-EXT-GNZBNJ2PO5MGZ6GT
+-A KUBE-POSTROUTING -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A KUBE-POSTROUTING -j MARK --set-xmark 0x4000/0x0
+-A KUBE-POSTROUTING -m comment --comment "kubernetes service traffic requiring SNAT" -j MASQUERADE --random-fully
+-A KUBE-SEP-2ZTR26TO4XFPTOIT -s 10.244.1.7/32 -m comment --comment "kube-system/kube-etcd:client" -j KUBE-MARK-MASQ
+-A KUBE-SEP-2ZTR26TO4XFPTOIT -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.244.1.7:2379
+-A KUBE-SEP-6E7XQMQ4RAYOWTTM -s 10.244.0.3/32 -m comment --comment "kube-system/kube-dns:dns-tcp" -j KUBE-MARK-MASQ
+-A KUBE-SEP-6E7XQMQ4RAYOWTTM -p tcp -m comment --comment "kube-system/kube-dns:dns-tcp" -m tcp -j DNAT --to-destination 10.244.0.3:53
+-A KUBE-SEP-N4G2XR5TDX7PQE7P -s 10.244.2.5/32 -m comment --comment "default/web:http" -j KUBE-MARK-MASQ
+-A KUBE-SEP-N4G2XR5TDX7PQE7P -p tcp -m comment --comment "default/web:http" -m tcp -j DNAT --to-destination 10.244.2.5:8080
+-A KUBE-SEP-YIL6JZP7A3QYXJU2 -s 172.18.0.2/32 -m comment --comment "default/kubernetes:https" -j KUBE-MARK-MASQ
+-A KUBE-SEP-YIL6JZP7A3QYXJU2 -p tcp -m comment --comment "default/kubernetes:https" -m tcp -j DNAT --to-destination 172.18.0.2:6443
+-A KUBE-SEP-ZP3FB6NMPNCO4VBJ -s 10.244.2.9/32 -m comment --comment "kube-system/kube-etcd:client" -j KUBE-MARK-MASQ
+-A KUBE-SEP-ZP3FB6NMPNCO4VBJ -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.244.2.9:2379
+-A KUBE-SERVICES -d 10.96.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -m tcp --dport 443 -j KUBE-SVC-NPX46M4PTMTKRN6Y
+-A KUBE-SERVICES -d 10.96.0.10/32 -p tcp -m comment --comment "kube-system/kube-dns:dns-tcp cluster IP" -m tcp --dport 53 -j KUBE-SVC-ERIFXISQEP7F7OF4
+-A KUBE-SERVICES -d 10.96.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-XGLOHA7QRQ3V22RZ
+-A KUBE-SERVICES -d 10.96.113.42/32 -p tcp -m comment --comment "default/web:http cluster IP" -m tcp --dport 80 -j KUBE-SVC-GNZBNJ2PO5MGZ6GT
+-A KUBE-SERVICES -d 10.96.87.201/32 -p tcp -m comment --comment "default/idle:http has no endpoints" -m tcp --dport 80 -j KUBE-SVC-JD5MR3NA4I4DYORP
+-A KUBE-SERVICES -m comment --comment "kubernetes service nodeports; NOTE: this must be the last rule in this chain" -m addrtype --dst-type LOCAL -j KUBE-NODEPORTS
+-A KUBE-SVC-ERIFXISQEP7F7OF4 ! -s 10.244.0.0/16 -d 10.96.0.10/32 -p tcp -m comment --comment "kube-system/kube-dns:dns-tcp cluster IP" -m tcp --dport 53 -j KUBE-MARK-MASQ
+-A KUBE-SVC-ERIFXISQEP7F7OF4 -m comment --comment "kube-system/kube-dns:dns-tcp -> 10.244.0.3:53" -j KUBE-SEP-6E7XQMQ4RAYOWTTM
+-A KUBE-SVC-GNZBNJ2PO5MGZ6GT ! -s 10.244.0.0/16 -d 10.96.113.42/32 -p tcp -m comment --comment "default/web:http cluster IP" -m tcp --dport 80 -j KUBE-MARK-MASQ
+-A KUBE-SVC-GNZBNJ2PO5MGZ6GT -m comment --comment "default/web:http -> 10.244.2.5:8080" -j KUBE-SEP-N4G2XR5TDX7PQE7P
+-A KUBE-SVC-NPX46M4PTMTKRN6Y ! -s 10.244.0.0/16 -d 10.96.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -m tcp --dport 443 -j KUBE-MARK-MASQ
+-A KUBE-SVC-NPX46M4PTMTKRN6Y -m comment --comment "default/kubernetes:https -> 172.18.0.2:6443" -j KUBE-SEP-YIL6JZP7A3QYXJU2
+-A KUBE-SVC-XGLOHA7QRQ3V22RZ ! -s 10.244.0.0/16 -d 10.96.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-MARK-MASQ
+-A KUBE-SVC-XGLOHA7QRQ3V22RZ -m comment --comment "kube-system/kube-etcd:client -> 10.244.1.7:2379" -m statistic --mode random --probability 0.50000000000 -j KUBE-SEP-2ZTR26TO4XFPTOIT
+-A KUBE-SVC-XGLOHA7QRQ3V22RZ -m comment --comment "kube-system/kube-etcd:client -> 10.244.2.9:2379" -j KUBE-SEP-ZP3FB6NMPNCO4VBJ
+COMMIT
+# Completed on Mon Jun 20 10:12:41 2022
+`)
+
+// exampleTablesV128 is the nat table programmed by kube-proxy v1.28 for a
+// cluster with a self hosted etcd and a service with
+// externalTrafficPolicy=Local.
+var exampleTablesV128 = []byte(`# Generated by iptables-save v1.8.9 (nf_tables) on Tue Oct 10 08:30:12 2023
+*nat
+:PREROUTING ACCEPT [0:0]
+:INPUT ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:KUBE-EXT-7EJNTS7AENER2WX5 - [0:0]
+:KUBE-KUBELET-CANARY - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-NODEPORTS - [0:0]
+:KUBE-POSTROUTING - [0:0]
+:KUBE-PROXY-CANARY - [0:0]
+:KUBE-SEP-3DOQHBKOUSGVXQQS - [0:0]
+:KUBE-SEP-KLUNSKGOEXMZRUPE - [0:0]
+:KUBE-SEP-VPILYQBSPPXYB66K - [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-7EJNTS7AENER2WX5 - [0:0]
+:KUBE-SVC-NPX46M4PTMTKRN6Y - [0:0]
+:KUBE-SVC-XGLOHA7QRQ3V22RZ - [0:0]
+:KUBE-SVL-7EJNTS7AENER2WX5 - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+-A KUBE-EXT-7EJNTS7AENER2WX5 -s 10.244.0.0/16 -m comment --comment "pod traffic for ingress-nginx/ingress-nginx-controller:http external destinations" -j KUBE-SVC-7EJNTS7AENER2WX5
+-A KUBE-EXT-7EJNTS7AENER2WX5 -m comment --comment "masquerade LOCAL traffic for ingress-nginx/ingress-nginx-controller:http external destinations" -m addrtype --src-type LOCAL -j KUBE-MARK-MASQ
+-A KUBE-EXT-7EJNTS7AENER2WX5 -m comment --comment "route LOCAL traffic for ingress-nginx/ingress-nginx-controller:http external destinations" -m addrtype --src-type LOCAL -j KUBE-SVC-7EJNTS7AENER2WX5
+-A KUBE-EXT-7EJNTS7AENER2WX5 -j KUBE-SVL-7EJNTS7AENER2WX5
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A KUBE-NODEPORTS -d 127.0.0.0/8 -p tcp -m comment --comment "ingress-nginx/ingress-nginx-controller:http" -m tcp --dport 31080 -m nfacct --nfacct-name localhost_nps_accepted_pkts -j KUBE-EXT-7EJNTS7AENER2WX5
+-A KUBE-NODEPORTS -p tcp -m comment --comment "ingress-nginx/ingress-nginx-controller:http" -m tcp --dport 31080 -j KUBE-EXT-7EJNTS7AENER2WX5
+-A KUBE-POSTROUTING -m mark ! --mark 0x4000/0x4000 -j RETURN
+-A KUBE-POSTROUTING -j MARK --set-xmark 0x4000/0x0
+-A KUBE-POSTROUTING -m comment --comment "kubernetes service traffic requiring SNAT" -j MASQUERADE --random-fully
+-A KUBE-SEP-3DOQHBKOUSGVXQQS -s 10.244.1.4/32 -m comment --comment "ingress-nginx/ingress-nginx-controller:http" -j KUBE-MARK-MASQ
+-A KUBE-SEP-3DOQHBKOUSGVXQQS -p tcp -m comment --comment "ingress-nginx/ingress-nginx-controller:http" -m tcp -j DNAT --to-destination 10.244.1.4:80
+-A KUBE-SEP-KLUNSKGOEXMZRUPE -s 172.18.0.3/32 -m comment --comment "default/kubernetes:https" -j KUBE-MARK-MASQ
+-A KUBE-SEP-KLUNSKGOEXMZRUPE -p tcp -m comment --comment "default/kubernetes:https" -m tcp -j DNAT --to-destination 172.18.0.3:6443
+-A KUBE-SEP-VPILYQBSPPXYB66K -s 10.244.2.3/32 -m comment --comment "kube-system/kube-etcd:client" -j KUBE-MARK-MASQ
+-A KUBE-SEP-VPILYQBSPPXYB66K -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.244.2.3:2379
+-A KUBE-SERVICES -d 10.96.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -m tcp --dport 443 -j KUBE-SVC-NPX46M4PTMTKRN6Y
+-A KUBE-SERVICES -d 10.96.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-XGLOHA7QRQ3V22RZ
+-A KUBE-SERVICES -d 10.96.200.17/32 -p tcp -m comment --comment "ingress-nginx/ingress-nginx-controller:http cluster IP" -m tcp --dport 80 -j KUBE-SVC-7EJNTS7AENER2WX5
+-A KUBE-SERVICES -m comment --comment "kubernetes service nodeports; NOTE: this must be the last rule in this chain" -m addrtype --dst-type LOCAL -j KUBE-NODEPORTS
+-A KUBE-SVC-7EJNTS7AENER2WX5 ! -s 10.244.0.0/16 -d 10.96.200.17/32 -p tcp -m comment --comment "ingress-nginx/ingress-nginx-controller:http cluster IP" -m tcp --dport 80 -j KUBE-MARK-MASQ
+-A KUBE-SVC-7EJNTS7AENER2WX5 -m comment --comment "ingress-nginx/ingress-nginx-controller:http -> 10.244.1.4:80" -j KUBE-SEP-3DOQHBKOUSGVXQQS
+-A KUBE-SVC-NPX46M4PTMTKRN6Y ! -s 10.244.0.0/16 -d 10.96.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -m tcp --dport 443 -j KUBE-MARK-MASQ
+-A KUBE-SVC-NPX46M4PTMTKRN6Y -m comment --comment "default/kubernetes:https -> 172.18.0.3:6443" -j KUBE-SEP-KLUNSKGOEXMZRUPE
+-A KUBE-SVC-XGLOHA7QRQ3V22RZ ! -s 10.244.0.0/16 -d 10.96.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-MARK-MASQ
+-A KUBE-SVC-XGLOHA7QRQ3V22RZ -m comment --comment "kube-system/kube-etcd:client -> 10.244.2.3:2379" -j KUBE-SEP-VPILYQBSPPXYB66K
+-A KUBE-SVL-7EJNTS7AENER2WX5 -m comment --comment "ingress-nginx/ingress-nginx-controller:http -> 10.244.1.4:80" -j KUBE-SEP-3DOQHBKOUSGVXQQS
+COMMIT
+# Completed on Tue Oct 10 08:30:12 2023
+`)
+
+// exampleFilterTablesV124 is the filter table programmed by kube-proxy v1.24
+// and the kubelet for the cluster of exampleTablesV124.
+var exampleFilterTablesV124 = []byte(`# Generated by iptables-save v1.8.7 on Mon Jun 20 10:12:41 2022
+*filter
+:INPUT ACCEPT [0:0]
+:FORWARD ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:DOCKER-USER - [0:0]
+:KUBE-EXTERNAL-SERVICES - [0:0]
+:KUBE-FIREWALL - [0:0]
+:KUBE-FORWARD - [0:0]
+:KUBE-KUBELET-CANARY - [0:0]
+:KUBE-NODEPORTS - [0:0]
+:KUBE-PROXY-CANARY - [0:0]
+:KUBE-SERVICES - [0:0]
+-A INPUT -m comment --comment "kubernetes health check service ports" -j KUBE-NODEPORTS
+-A INPUT -m conntrack --ctstate NEW -m comment --comment "kubernetes externally-visible service portals" -j KUBE-EXTERNAL-SERVICES
+-A INPUT -j KUBE-FIREWALL
+-A FORWARD -j DOCKER-USER
+-A FORWARD -m comment --comment "kubernetes forwarding rules" -j KUBE-FORWARD
+-A FORWARD -m conntrack --ctstate NEW -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A FORWARD -m conntrack --ctstate NEW -m comment --comment "kubernetes externally-visible service portals" -j KUBE-EXTERNAL-SERVICES
+-A OUTPUT -m conntrack --ctstate NEW -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -j KUBE-FIREWALL
+-A DOCKER-USER -j RETURN
+-A KUBE-EXTERNAL-SERVICES -p tcp -m comment --comment "default/idle:http has no endpoints" -m addrtype --dst-type LOCAL -m tcp --dport 30081 -j REJECT --reject-with icmp-port-unreachable
+-A KUBE-FIREWALL -m comment --comment "kubernetes firewall for dropping marked packets" -m mark --mark 0x8000/0x8000 -j DROP
+-A KUBE-FIREWALL ! -s 127.0.0.0/8 -d 127.0.0.0/8 -m comment --comment "block incoming localnet connections" -m conntrack ! --ctstate RELATED,ESTABLISHED,DNAT -j DROP
+-A KUBE-FORWARD -m conntrack --ctstate INVALID -j DROP
+-A KUBE-FORWARD -m comment --comment "kubernetes forwarding rules" -m mark --mark 0x4000/0x4000 -j ACCEPT
+-A KUBE-FORWARD -m comment --comment "kubernetes forwarding conntrack rule" -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A KUBE-SERVICES -d 10.96.87.201/32 -p tcp -m comment --comment "default/idle:http has no endpoints" -m tcp --dport 80 -j REJECT --reject-with icmp-port-unreachable
+COMMIT
+# Completed on Mon Jun 20 10:12:41 2022
+`)
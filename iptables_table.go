@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+// iptablesTable is a single table parsed from iptables-save data.
+type iptablesTable struct {
+	table utiliptables.Table
+	// chains in declaration order
+	chains []utiliptables.Chain
+	// chain declaration lines by chain
+	chainLines map[utiliptables.Chain]string
+	// rules in the order they were saved
+	rules []iptablesRule
+}
+
+// iptablesRule is a single "-A <chain> ..." line of a table.
+type iptablesRule struct {
+	chain utiliptables.Chain
+	line  string
+}
+
+// parseTable parses the given table from iptables-save data. It returns nil
+// if the table is not in the data.
+func parseTable(table utiliptables.Table, save []byte) (*iptablesTable, error) {
+	var ri int
+
+	tableStarts := "*" + string(table)
+
+	// find beginning of the table
+	found := false
+	for ri < len(save) {
+		line, n := utiliptables.ReadLine(ri, save)
+		ri = n
+		if strings.HasPrefix(line, tableStarts) {
+			found = true
+			break
+		}
+	}
+
+	if !found || ri >= len(save) {
+		return nil, nil
+	}
+
+	t := &iptablesTable{
+		table:      table,
+		chainLines: make(map[utiliptables.Chain]string),
+	}
+
+	var done bool
+	// parse table lines
+	for ri < len(save) && !done {
+		line, n := utiliptables.ReadLine(ri, save)
+		ri = n
+
+		switch {
+		case len(line) == 0:
+		case strings.HasPrefix(line, "COMMIT"):
+			done = true
+		case strings.HasPrefix(line, "*"):
+			// unexpected new table before we commit the table
+			return nil, fmt.Errorf("unexpected table line: %v", line)
+		case strings.HasPrefix(line, "#"):
+			// ignore comment lines
+		case strings.HasPrefix(line, ":"):
+			chain := utiliptables.Chain(strings.SplitN(line[1:], " ", 2)[0])
+			t.chains = append(t.chains, chain)
+			t.chainLines[chain] = line
+		case strings.HasPrefix(line, "-A "):
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("unexpected rule line: %v", line)
+			}
+			t.rules = append(t.rules, iptablesRule{chain: utiliptables.Chain(fields[1]), line: line})
+		default:
+			return nil, fmt.Errorf("unexpected line: %v", line)
+		}
+	}
+
+	if !done {
+		return nil, fmt.Errorf("failed to find the COMMIT LINE")
+	}
+
+	return t, nil
+}
+
+// iptablesTargets are the targets a rule may jump to that are not chains.
+var iptablesTargets = map[string]bool{
+	"ACCEPT":     true,
+	"DROP":       true,
+	"RETURN":     true,
+	"QUEUE":      true,
+	"REJECT":     true,
+	"LOG":        true,
+	"DNAT":       true,
+	"SNAT":       true,
+	"MASQUERADE": true,
+	"REDIRECT":   true,
+	"NETMAP":     true,
+	"MARK":       true,
+	"CONNMARK":   true,
+	"NOTRACK":    true,
+	"CT":         true,
+	"NFLOG":      true,
+	"TRACE":      true,
+}
+
+// closure returns the given chains and all chains reachable from them by
+// following the jumps of their rules. Jumps to chains that are not
+// declared in the table are ignored, see validate.
+func (t *iptablesTable) closure(roots []utiliptables.Chain) map[utiliptables.Chain]bool {
+	rulesByChain := make(map[utiliptables.Chain][]iptablesRule)
+	for _, r := range t.rules {
+		rulesByChain[r.chain] = append(rulesByChain[r.chain], r)
+	}
+
+	keep := make(map[utiliptables.Chain]bool)
+	var queue []utiliptables.Chain
+	follow := func(c utiliptables.Chain) {
+		if _, ok := t.chainLines[c]; ok && !keep[c] {
+			keep[c] = true
+			queue = append(queue, c)
+		}
+	}
+
+	for _, c := range roots {
+		follow(c)
+	}
+	for len(queue) > 0 {
+		c := queue[0]
+		queue = queue[1:]
+		for _, r := range rulesByChain[c] {
+			follow(utiliptables.Chain(r.target()))
+		}
+	}
+	return keep
+}
+
+// validate returns an error if one of the given rules is in or jumps to a
+// chain that is not one of the given chains, which would make restoring
+// them fail or jump into an empty chain.
+func validate(chains map[utiliptables.Chain]bool, rules []iptablesRule) error {
+	for _, r := range rules {
+		if !chains[r.chain] {
+			return fmt.Errorf("rule appends to undefined chain %s: %v", r.chain, r.line)
+		}
+		target := r.target()
+		if len(target) == 0 || iptablesTargets[target] {
+			continue
+		}
+		if !chains[utiliptables.Chain(target)] {
+			return fmt.Errorf("rule jumps to undefined chain %s: %v", target, r.line)
+		}
+	}
+	return nil
+}
+
+// bytes returns the iptables-restore data of the given chains and rules of
+// the table, in the order they were saved.
+func (t *iptablesTable) bytes(chains map[utiliptables.Chain]bool, rules []iptablesRule) []byte {
+	lines := []string{"*" + string(t.table)}
+	for _, c := range t.chains {
+		if chains[c] {
+			lines = append(lines, t.chainLines[c])
+		}
+	}
+	for _, r := range rules {
+		lines = append(lines, r.line)
+	}
+	lines = append(lines, "COMMIT")
+
+	after := []byte(strings.Join(lines, "\n"))
+	after = append(after, '\n')
+
+	return after
+}
+
+// splitRuleArgs splits a rule line into its arguments. Double quoted
+// arguments, like comments, are returned without quotes.
+func splitRuleArgs(line string) []string {
+	var (
+		args    []string
+		cur     []rune
+		inQuote bool
+		inArg   bool
+	)
+	for _, c := range line {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+			inArg = true
+		case c == ' ' && !inQuote:
+			if inArg {
+				args = append(args, string(cur))
+				cur = cur[:0]
+				inArg = false
+			}
+		default:
+			cur = append(cur, c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, string(cur))
+	}
+	return args
+}
+
+// argValue returns the value following the first of the given flags in the
+// rule, or "" if the rule has none of the flags.
+func (r iptablesRule) argValue(flags ...string) string {
+	args := splitRuleArgs(r.line)
+	for i := 0; i < len(args)-1; i++ {
+		for _, f := range flags {
+			if args[i] == f {
+				return args[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// target returns the chain or target the rule jumps to, or "" if it has none.
+func (r iptablesRule) target() string {
+	return r.argValue("-j", "--jump", "-g", "--goto")
+}
+
+// comment returns the comment of the rule, or "" if it has none.
+func (r iptablesRule) comment() string {
+	return r.argValue("--comment")
+}
+
+// isRestored returns true if the rule was restored from a checkpoint and
+// not rewritten by kube-proxy since, see kencRestoredComment.
+func (r iptablesRule) isRestored() bool {
+	return r.comment() == kencRestoredComment
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	utildbus "github.com/coreos/kenc/pkg/util/dbus"
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+)
+
+func TestSplitEndpointsByFamily(t *testing.T) {
+	eps := []string{
+		"10.2.0.4:2379",
+		"[fd00::4]:2379",
+		"10.2.0.5:2379",
+		"not-an-endpoint",
+		"[fd00::5]:2379",
+	}
+
+	eps4, eps6 := splitEndpointsByFamily(eps)
+
+	want4 := []string{"10.2.0.4:2379", "10.2.0.5:2379"}
+	if !reflect.DeepEqual(eps4, want4) {
+		t.Errorf("expected IPv4 endpoints %v, got %v", want4, eps4)
+	}
+	want6 := []string{"[fd00::4]:2379", "[fd00::5]:2379"}
+	if !reflect.DeepEqual(eps6, want6) {
+		t.Errorf("expected IPv6 endpoints %v, got %v", want6, eps6)
+	}
+}
+
+func TestSaveIPtablesKeepsCheckpointOnInvalidRules(t *testing.T) {
+	fcmd := utilexec.FakeCmd{
+		CombinedOutputScript: []utilexec.FakeCombinedOutputAction{
+			// iptables version check
+			func() ([]byte, error) { return []byte("iptables v1.6.1"), nil },
+			func() ([]byte, error) { return exampleTablesV124, nil },
+			func() ([]byte, error) {
+				return []byte("iptables-restore: line 12 failed"), &utilexec.FakeExitError{Status: 1}
+			},
+		},
+	}
+	fexec := utilexec.FakeExec{
+		CommandScript: []utilexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	ipt := utiliptables.New(&fexec, utildbus.NewFake(nil, nil), utiliptables.ProtocolIpv4)
+	defer ipt.Destroy()
+
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	previous := []byte("*nat\nCOMMIT\n")
+	if err = ioutil.WriteFile(path.Join(dir, iptablesCheckpointFile), previous, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sel := iptablesSelection{
+		tables:   []utiliptables.Table{utiliptables.TableNAT},
+		patterns: chainProfiles["v1.24"],
+	}
+	if err = saveIPtables(ipt, "10.96.0.15", sel, dir, iptablesCheckpointFile); err == nil {
+		t.Fatal("expected failure for invalid rules")
+	}
+
+	got, err := ioutil.ReadFile(path.Join(dir, iptablesCheckpointFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(previous) {
+		t.Error("got replaced checkpoint")
+		t.Error(string(got))
+	}
+}
+
+func TestSaveIPtablesKeepsCheckpointWithoutEtcdService(t *testing.T) {
+	tests := []struct {
+		name string
+		save []byte
+	}{
+		{"no kube chains", []byte("*nat\n:PREROUTING ACCEPT [0:0]\n:OUTPUT ACCEPT [0:0]\nCOMMIT\n")},
+		// kube-proxy programmed other services only
+		{"no etcd service rule", exampleTables},
+	}
+	for _, tt := range tests {
+		save := tt.save
+		fcmd := utilexec.FakeCmd{
+			CombinedOutputScript: []utilexec.FakeCombinedOutputAction{
+				// iptables version check
+				func() ([]byte, error) { return []byte("iptables v1.6.1"), nil },
+				func() ([]byte, error) { return save, nil },
+			},
+		}
+		fexec := utilexec.FakeExec{
+			CommandScript: []utilexec.FakeCommandAction{
+				func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+				func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+			},
+		}
+		ipt := utiliptables.New(&fexec, utildbus.NewFake(nil, nil), utiliptables.ProtocolIpv4)
+
+		dir, err := ioutil.TempDir("", "kenc")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		previous := exampleTablesV124
+		if err = ioutil.WriteFile(path.Join(dir, iptablesCheckpointFile), previous, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		sel := iptablesSelection{
+			tables:   []utiliptables.Table{utiliptables.TableNAT},
+			patterns: chainProfiles[defaultChainProfile],
+		}
+		if err = saveIPtables(ipt, "10.96.0.15", sel, dir, iptablesCheckpointFile); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		got, err := ioutil.ReadFile(path.Join(dir, iptablesCheckpointFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(previous) {
+			t.Errorf("%s: got replaced checkpoint", tt.name)
+		}
+		if fexec.CommandCalls != 2 {
+			t.Errorf("%s: expected no validation of the checkpoint, got %d commands", tt.name, fexec.CommandCalls)
+		}
+
+		ipt.Destroy()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGetMissingTableLines(t *testing.T) {
+	checkpoint := []byte(`*nat
+:KUBE-SERVICES - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-SVC-ETCD - [0:0]
+:KUBE-SEP-ETCD - [0:0]
+-A KUBE-SERVICES -d 10.3.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-ETCD
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A KUBE-SVC-ETCD -m comment --comment "kube-system/kube-etcd:client" -j KUBE-SEP-ETCD
+-A KUBE-SEP-ETCD -s 10.2.0.4/32 -m comment --comment "kube-system/kube-etcd:client" -j KUBE-MARK-MASQ
+-A KUBE-SEP-ETCD -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.2.0.4:2379
+COMMIT
+`)
+
+	// kube-proxy is up but has not synced the etcd service yet
+	live := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-SVC-API - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A KUBE-SERVICES -d 10.3.0.1/32 -p tcp -m comment --comment "default/kubernetes:https cluster IP" -m tcp --dport 443 -j KUBE-SVC-API
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+COMMIT
+`)
+
+	got, partial, err := getMissingTableLines(utiliptables.TableNAT, checkpoint, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial {
+		t.Error("expected partial restore")
+	}
+	want := []byte(`*nat
+:KUBE-SVC-ETCD - [0:0]
+:KUBE-SEP-ETCD - [0:0]
+-A KUBE-SERVICES -d 10.3.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-ETCD
+-A KUBE-SVC-ETCD -m comment --comment "kube-system/kube-etcd:client" -j KUBE-SEP-ETCD
+-A KUBE-SEP-ETCD -s 10.2.0.4/32 -m comment --comment "kube-system/kube-etcd:client" -j KUBE-MARK-MASQ
+-A KUBE-SEP-ETCD -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.2.0.4:2379
+COMMIT
+`)
+	if !bytes.Equal(got, want) {
+		t.Error("got wrong missing table")
+		t.Error(string(want))
+		t.Error(string(got))
+	}
+
+	// nothing is live after a reboot
+	got, partial, err = getMissingTableLines(utiliptables.TableNAT, checkpoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial || !bytes.Equal(got, checkpoint) {
+		t.Error("expected full restore")
+		t.Error(string(got))
+	}
+
+	// after a reboot, setup has ensured the linked chains empty
+	checkpoint = []byte(`*nat
+:KUBE-SERVICES - [0:0]
+:KUBE-POSTROUTING - [0:0]
+:KUBE-MARK-MASQ - [0:0]
+-A KUBE-SERVICES -d 10.3.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-MARK-MASQ
+-A KUBE-POSTROUTING -m comment --comment "kubernetes service traffic requiring SNAT" -m mark --mark 0x4000/0x4000 -j MASQUERADE
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+COMMIT
+`)
+	ensured := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:POSTROUTING ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-POSTROUTING - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A POSTROUTING -m comment --comment "kubernetes postrouting rules" -j KUBE-POSTROUTING
+COMMIT
+`)
+	got, partial, err = getMissingTableLines(utiliptables.TableNAT, checkpoint, ensured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial || !bytes.Equal(got, checkpoint) {
+		t.Error("expected full restore into the empty chains")
+		t.Error(string(got))
+	}
+
+	// everything is live
+	got, partial, err = getMissingTableLines(utiliptables.TableNAT, checkpoint, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial || got != nil {
+		t.Error("expected nothing to restore")
+		t.Error(string(got))
+	}
+}
+
+func TestIsEtcdServiceProgrammed(t *testing.T) {
+	nat, err := parseTable(utiliptables.TableNAT, exampleTablesV124)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEtcdServiceProgrammed(nat, "10.96.0.15") {
+		t.Error("expected etcd service rules to be found")
+	}
+	if isEtcdServiceProgrammed(nat, "10.96.0.10") {
+		t.Error("expected no etcd service rules for the dns service ip")
+	}
+	if isEtcdServiceProgrammed(nil, "10.96.0.15") {
+		t.Error("expected no etcd service rules without nat table")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	utilipvs "github.com/coreos/kenc/pkg/util/ipvs"
+)
+
+const (
+	ipvsCheckpointFile = "ipvs.checkpoint"
+
+	// the dummy device kube-proxy binds the service ips to in IPVS mode
+	kubeIPVSDevice = "kube-ipvs0"
+)
+
+// getEtcdVirtualServerLines returns the lines of the given `ipvsadm --save -n`
+// output that define the virtual servers for the given service ips on the
+// etcd client port and their real servers.
+func getEtcdVirtualServerLines(save []byte, vips []string) ([]byte, error) {
+	services := make(map[string]bool)
+	for _, vip := range vips {
+		services[net.JoinHostPort(vip, clientPort())] = true
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(save), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "-A", "-a":
+			// "-A -t <vip>:<port> ..." adds a virtual server,
+			// "-a -t <vip>:<port> -r <endpoint> ..." adds a real server to it.
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("unexpected ipvs line: %v", line)
+			}
+			if fields[1] == "-t" && services[fields[2]] {
+				lines = append(lines, line)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected ipvs line: %v", line)
+		}
+	}
+
+	if len(lines) == 0 {
+		// nothing to checkpoint
+		return nil, nil
+	}
+
+	after := []byte(strings.Join(lines, "\n"))
+	after = append(after, '\n')
+
+	return after, nil
+}
+
+// saveIPVS saves the IPVS virtual servers for the given service ips into the given file.
+// This is used to implement IPVS level checkpoint.
+func saveIPVS(ipvs utilipvs.Interface, vips []string, dir, filename string) error {
+	b, err := ipvs.SaveAll()
+	if err != nil {
+		return err
+	}
+
+	b, err = getEtcdVirtualServerLines(b, vips)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		// kube-proxy may be restarting, keep the previous checkpoint
+		log.Printf("no IPVS virtual server for the etcd service ip, keeping the previous checkpoint")
+		return nil
+	}
+
+	return writeCheckpoint(dir, filename, b)
+}
+
+// getProgrammedVIPs returns the given service ips that have a virtual
+// server on the etcd client port in the given `ipvsadm --save -n` output.
+func getProgrammedVIPs(save []byte, vips []string) (map[string]bool, error) {
+	programmed := make(map[string]bool)
+	for _, vip := range vips {
+		lines, err := getEtcdVirtualServerLines(save, []string{vip})
+		if err != nil {
+			return nil, err
+		}
+		if len(lines) > 0 {
+			programmed[vip] = true
+		}
+	}
+	return programmed, nil
+}
+
+// restoreIPVSFromFile restores the IPVS virtual servers for the given
+// service ips from the given file. The service ips kube-proxy has already
+// programmed a virtual server for are left alone. The others are bound to
+// the kube-proxy dummy device so that the host accepts the traffic sent to
+// them.
+// This is used to implement IPVS level checkpoint.
+func restoreIPVSFromFile(ipvs utilipvs.Interface, vips []string, filepath string) error {
+	b, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		// nothing was checkpointed, keep the existing virtual servers
+		return nil
+	}
+
+	live, err := ipvs.SaveAll()
+	if err != nil {
+		return err
+	}
+	programmed, err := getProgrammedVIPs(live, vips)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, vip := range vips {
+		if programmed[vip] {
+			log.Printf("kube-proxy has programmed the etcd service ip %s, skipping its IPVS checkpoint", vip)
+			continue
+		}
+		missing = append(missing, vip)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	b, err = getEtcdVirtualServerLines(b, missing)
+	if err != nil {
+		return err
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	log.Printf("restoring the IPVS checkpoint of the etcd service ips %v", missing)
+
+	if _, err = ipvs.EnsureDummyDevice(kubeIPVSDevice); err != nil {
+		return err
+	}
+	for _, vip := range missing {
+		if _, err = ipvs.EnsureAddressBind(vip, kubeIPVSDevice); err != nil {
+			return err
+		}
+		// restoring an existing virtual server fails
+		if err = ipvs.DeleteVirtualServer(net.JoinHostPort(vip, clientPort())); err != nil {
+			return err
+		}
+	}
+
+	return ipvs.RestoreAll(b)
+}
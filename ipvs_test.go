@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestGetEtcdVirtualServerLines(t *testing.T) {
+	save := []byte(`-A -t 10.3.0.1:443 -s rr
+-a -t 10.3.0.1:443 -r 172.17.4.101:443 -m -w 1
+-A -t 10.3.0.15:2379 -s rr
+-a -t 10.3.0.15:2379 -r 10.2.0.4:2379 -m -w 1
+-a -t 10.3.0.15:2379 -r 10.2.0.5:2379 -m -w 1
+-A -t [fd00:10:3::15]:2379 -s rr
+-a -t [fd00:10:3::15]:2379 -r [fd00::4]:2379 -m -w 1
+-A -u 10.3.0.10:53 -s rr
+-a -u 10.3.0.10:53 -r 10.2.0.9:53 -m -w 1
+`)
+
+	got, err := getEtcdVirtualServerLines(save, []string{"10.3.0.15", "fd00:10:3::15"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `-A -t 10.3.0.15:2379 -s rr
+-a -t 10.3.0.15:2379 -r 10.2.0.4:2379 -m -w 1
+-a -t 10.3.0.15:2379 -r 10.2.0.5:2379 -m -w 1
+-A -t [fd00:10:3::15]:2379 -s rr
+-a -t [fd00:10:3::15]:2379 -r [fd00::4]:2379 -m -w 1
+`
+	if string(got) != want {
+		t.Error("got wrong virtual servers")
+		t.Error(want)
+		t.Error(string(got))
+	}
+
+	if _, err = getEtcdVirtualServerLines([]byte("garbage\n"), []string{"10.3.0.15"}); err == nil {
+		t.Error("expected failure")
+	}
+}
+
+// fakeIPVS records the calls of restoreIPVSFromFile.
+type fakeIPVS struct {
+	save     []byte
+	restored []byte
+	deleted  []string
+	bound    []string
+}
+
+func (f *fakeIPVS) SaveAll() ([]byte, error) { return f.save, nil }
+
+func (f *fakeIPVS) RestoreAll(data []byte) error {
+	f.restored = data
+	return nil
+}
+
+func (f *fakeIPVS) DeleteVirtualServer(address string) error {
+	f.deleted = append(f.deleted, address)
+	return nil
+}
+
+func (f *fakeIPVS) EnsureDummyDevice(dev string) (bool, error) { return true, nil }
+
+func (f *fakeIPVS) EnsureAddressBind(address, dev string) (bool, error) {
+	f.bound = append(f.bound, address)
+	return true, nil
+}
+
+func TestRestoreIPVSFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkpoint := `-A -t 10.3.0.15:2379 -s rr
+-a -t 10.3.0.15:2379 -r 10.2.0.4:2379 -m -w 1
+-A -t [fd00:10:3::15]:2379 -s rr
+-a -t [fd00:10:3::15]:2379 -r [fd00::4]:2379 -m -w 1
+`
+	file := path.Join(dir, ipvsCheckpointFile)
+	if err = ioutil.WriteFile(file, []byte(checkpoint), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vips := []string{"10.3.0.15", "fd00:10:3::15"}
+
+	// kube-proxy has programmed the IPv4 service ip
+	f := &fakeIPVS{save: []byte("-A -t 10.3.0.15:2379 -s rr\n-a -t 10.3.0.15:2379 -r 10.2.0.5:2379 -m -w 1\n")}
+	if err = restoreIPVSFromFile(f, vips, file); err != nil {
+		t.Fatal(err)
+	}
+	want := "-A -t [fd00:10:3::15]:2379 -s rr\n-a -t [fd00:10:3::15]:2379 -r [fd00::4]:2379 -m -w 1\n"
+	if string(f.restored) != want {
+		t.Errorf("got wrong restored virtual servers, want=%q, got=%q", want, f.restored)
+	}
+	if !reflect.DeepEqual(f.deleted, []string{"[fd00:10:3::15]:2379"}) || !reflect.DeepEqual(f.bound, []string{"fd00:10:3::15"}) {
+		t.Errorf("expected the programmed virtual server to be kept, deleted %v, bound %v", f.deleted, f.bound)
+	}
+
+	// both are programmed
+	f = &fakeIPVS{save: []byte(checkpoint)}
+	if err = restoreIPVSFromFile(f, vips, file); err != nil {
+		t.Fatal(err)
+	}
+	if f.restored != nil || f.deleted != nil {
+		t.Errorf("expected nothing to be restored, restored %q, deleted %v", f.restored, f.deleted)
+	}
+}
+
+func TestSaveIPVSKeepsCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkpoint := "-A -t 10.3.0.15:2379 -s rr\n"
+	f := &fakeIPVS{save: []byte(checkpoint)}
+	if err = saveIPVS(f, []string{"10.3.0.15"}, dir, ipvsCheckpointFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// no etcd virtual server keeps the previous checkpoint
+	f.save = []byte("-A -t 10.3.0.1:443 -s rr\n")
+	if err = saveIPVS(f, []string{"10.3.0.15"}, dir, ipvsCheckpointFile); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path.Join(dir, ipvsCheckpointFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != checkpoint {
+		t.Errorf("got wrong checkpoint, want=%q, got=%q", checkpoint, b)
+	}
+}
@@ -9,143 +9,313 @@ import (
 )
 
 const (
-	natTable = "nat"
-
 	// the services chain
 	kubeServicesChain utiliptables.Chain = "KUBE-SERVICES"
 	// the kubernetes postrouting chain
 	kubePostroutingChain utiliptables.Chain = "KUBE-POSTROUTING"
+	// the kubernetes nodeports chain
+	kubeNodePortsChain utiliptables.Chain = "KUBE-NODEPORTS"
+	// the kubernetes forwarding rules chain
+	kubeForwardChain utiliptables.Chain = "KUBE-FORWARD"
+	// the kubelet firewall chain
+	kubeFirewallChain utiliptables.Chain = "KUBE-FIREWALL"
+	// the externally visible services chain
+	kubeExternalServicesChain utiliptables.Chain = "KUBE-EXTERNAL-SERVICES"
+	// the load balancer source ranges chain
+	kubeProxyFirewallChain utiliptables.Chain = "KUBE-PROXY-FIREWALL"
 )
 
-var kubeKeywords = map[string]bool{
-	// Chains defined in kube-proxy as global consts
-	"KUBE-SERVICES":    true,
-	"KUBE-HOSTPORTS":   true,
-	"KUBE-NODEPORTS":   true,
-	"KUBE-POSTROUTING": true,
-	"KUBE-MARK-MASQ":   true,
-	"KUBE-MARK-DROP":   true,
-	// Chains/Rules defined in kube-proxy as in line consts
-	// https://github.com/kubernetes/kubernetes/blob/20ed2a2744cdb0f790df9f792cdda5727726e102/pkg/proxy/iptables/proxier.go#L1315
-	"KUBE-SVC-": true,
-	"KUBE-SEP-": true,
-	"KUBE-FW-":  true,
-	"KUBE-XLB-": true,
+// iptablesSelection selects the rules saved by the iptables checkpoint.
+type iptablesSelection struct {
+	// tables to checkpoint
+	tables []utiliptables.Table
+	// patterns match the chains created by kube-proxy
+	patterns chainPatterns
+	// services to checkpoint, all if empty
+	services []serviceSelector
+}
+
+// chainLink is a rule linking a top level chain to a kube-proxy chain.
+type chainLink struct {
+	chain   utiliptables.Chain
+	target  utiliptables.Chain
+	comment string
+}
+
+func (l chainLink) args() []string {
+	if len(l.comment) == 0 {
+		return []string{"-j", string(l.target)}
+	}
+	return []string{"-m", "comment", "--comment", l.comment, "-j", string(l.target)}
+}
+
+// kubeTable describes how a table programmed by kube-proxy is checkpointed.
+type kubeTable struct {
+	// Top level chains that will not be flushed in the restore transaction.
+	// The rules linking them to the kube-proxy chains are ensured by ensureLinkingChains.
+	nonFlushChains map[utiliptables.Chain]bool
+	// links are the rules ensured by ensureLinkingChains.
+	links []chainLink
+	// serviceChains hold the per service rules filtered by service selectors.
+	serviceChains map[utiliptables.Chain]bool
+	// sharedChains are kept with the selected services.
+	sharedChains []utiliptables.Chain
 }
 
-// Top level chains that will not be flushed in the restore transaction.
-var nonFlushChains = map[string]bool{
-	"-A PREROUTING":  true,
-	"-A POSTROUTING": true,
-	"-A INPUT":       true,
-	"-A OUTPUT":      true,
+// kubeTables are the tables that can be checkpointed.
+var kubeTables = map[utiliptables.Table]kubeTable{
+	utiliptables.TableNAT: {
+		nonFlushChains: map[utiliptables.Chain]bool{
+			utiliptables.ChainPrerouting:  true,
+			utiliptables.ChainPostrouting: true,
+			utiliptables.ChainInput:       true,
+			utiliptables.ChainOutput:      true,
+		},
+		links: []chainLink{
+			{utiliptables.ChainOutput, kubeServicesChain, "kubernetes service portals"},
+			{utiliptables.ChainPrerouting, kubeServicesChain, "kubernetes service portals"},
+			{utiliptables.ChainPostrouting, kubePostroutingChain, "kubernetes postrouting rules"},
+		},
+		serviceChains: map[utiliptables.Chain]bool{
+			kubeServicesChain:  true,
+			kubeNodePortsChain: true,
+		},
+		// it masquerades the marked packets
+		sharedChains: []utiliptables.Chain{kubePostroutingChain},
+	},
+	utiliptables.TableFilter: {
+		nonFlushChains: map[utiliptables.Chain]bool{
+			utiliptables.ChainInput:   true,
+			utiliptables.ChainForward: true,
+			utiliptables.ChainOutput:  true,
+		},
+		links: []chainLink{
+			{utiliptables.ChainForward, kubeForwardChain, "kubernetes forwarding rules"},
+			{utiliptables.ChainInput, kubeFirewallChain, ""},
+			{utiliptables.ChainOutput, kubeFirewallChain, ""},
+			{utiliptables.ChainInput, kubeExternalServicesChain, "kubernetes externally-visible service portals"},
+			{utiliptables.ChainOutput, kubeServicesChain, "kubernetes service portals"},
+		},
+		serviceChains: map[utiliptables.Chain]bool{
+			kubeServicesChain:         true,
+			kubeExternalServicesChain: true,
+			kubeNodePortsChain:        true,
+			kubeProxyFirewallChain:    true,
+		},
+		// they accept the forwarded service traffic and drop martian packets
+		sharedChains: []utiliptables.Chain{kubeForwardChain, kubeFirewallChain},
+	},
 }
 
-func getKubeNATTableLines(save []byte) ([]byte, error) {
-	var (
-		lines []string
-		ri    int
-	)
-
-	natTableStarts := "*" + natTable
-
-	// find beginning of nat table and save it
-	for ri < len(save) {
-		line, n := utiliptables.ReadLine(ri, save)
-		ri = n
-		if strings.HasPrefix(line, natTableStarts) {
-			lines = append(lines, line)
-			break
+// parseIptablesTables parses a comma separated list of tables to checkpoint.
+func parseIptablesTables(s string) ([]utiliptables.Table, error) {
+	var tables []utiliptables.Table
+	seen := map[utiliptables.Table]bool{}
+	for _, item := range strings.Split(s, ",") {
+		table := utiliptables.Table(strings.TrimSpace(item))
+		if len(table) == 0 || seen[table] {
+			continue
 		}
+		if _, ok := kubeTables[table]; !ok {
+			return nil, fmt.Errorf("unsupported iptables table %q", table)
+		}
+		seen[table] = true
+		tables = append(tables, table)
+	}
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no iptables tables configured")
 	}
+	return tables, nil
+}
 
-	if ri >= len(save) {
+// isNonFlushRule returns true if the given rule is in one of the top level chains.
+func (kt kubeTable) isNonFlushRule(r iptablesRule) bool {
+	return kt.nonFlushChains[r.chain]
+}
+
+// getKubeTableLines returns the lines of the kube-proxy chains of the given
+// table reachable from its top level chains. The roots are the kube-proxy chains
+// the top level chains jump to and the kube-proxy global chains, as matched
+// by the given patterns. From them, every chain jumped to is kept with all
+// of its rules. It returns an error if the kept rules jump to an undefined chain.
+func getKubeTableLines(table utiliptables.Table, save []byte, patterns chainPatterns) ([]byte, error) {
+	t, err := parseTable(table, save)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
 		// nothing to checkpoint
 		return nil, nil
 	}
 
-	var done bool
-	// parse table lines
-	for ri < len(save) && !done {
-		line, n := utiliptables.ReadLine(ri, save)
-		ri = n
-
-		switch {
-		case strings.HasPrefix(line, "COMMIT"):
-			// save commit line and we are done!
-			lines = append(lines, line)
-			done = true
-		case strings.HasPrefix(line, "*"):
-			// unexpected new table before we commit the NAT table
-			return nil, fmt.Errorf("unexpected table line: %v", line)
-		case strings.HasPrefix(line, "#"):
-			// ignore comment lines
-		default:
-			ok := true
-			for nc := range nonFlushChains {
-				if strings.HasPrefix(line, nc) {
-					ok = false
-					break
-				}
-			}
-			if !ok {
-				continue
-			}
+	var roots []utiliptables.Chain
+	for _, r := range t.rules {
+		if !kubeTables[table].isNonFlushRule(r) {
+			continue
+		}
+		if c := utiliptables.Chain(r.target()); patterns.isKubeChain(c) {
+			roots = append(roots, c)
+		}
+	}
+	for _, c := range t.chains {
+		if patterns.isGlobalChain(c) {
+			roots = append(roots, c)
+		}
+	}
 
-			// normal lines, save them if they match Kube rules
-			for k := range kubeKeywords {
-				if strings.Contains(line, k) {
-					lines = append(lines, line)
-					break
-				}
-			}
+	chains := t.closure(roots)
+
+	var rules []iptablesRule
+	for _, r := range t.rules {
+		if chains[r.chain] {
+			rules = append(rules, r)
 		}
 	}
 
-	if !done {
-		return nil, fmt.Errorf("failed to find the COMMIT LINE")
+	if err = validate(chains, rules); err != nil {
+		return nil, err
 	}
+	return t.bytes(chains, rules), nil
+}
 
-	after := []byte(strings.Join(lines, "\n"))
-	after = append(after, '\n')
+// serviceSelector selects the kube-proxy rules of a service by the
+// "namespace/name:port" comment kube-proxy annotates them with.
+type serviceSelector struct {
+	namespace string
+	name      string
+	// port is the name of the service port, which is empty for unnamed
+	// ports. It is ignored if anyPort is set.
+	port    string
+	anyPort bool
+}
 
-	return after, nil
+// parseServiceSelectors parses a comma separated list of "namespace/name[:port]"
+// service selectors. A selector without port selects all ports of the service.
+func parseServiceSelectors(s string) ([]serviceSelector, error) {
+	var sels []serviceSelector
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		sel := serviceSelector{anyPort: true}
+		nsName := item
+		if i := strings.Index(item, ":"); i >= 0 {
+			nsName = item[:i]
+			sel.port = item[i+1:]
+			sel.anyPort = false
+		}
+		parts := strings.Split(nsName, "/")
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("invalid service selector %q: expected namespace/name[:port]", item)
+		}
+		sel.namespace, sel.name = parts[0], parts[1]
+		sels = append(sels, sel)
+	}
+	return sels, nil
+}
+
+func (sel serviceSelector) String() string {
+	if sel.anyPort {
+		return sel.namespace + "/" + sel.name
+	}
+	return sel.namespace + "/" + sel.name + ":" + sel.port
+}
+
+// matches returns true if the given kube-proxy rule comment, e.g.
+// "kube-system/kube-dns:dns cluster IP", belongs to the selected service.
+func (sel serviceSelector) matches(comment string) bool {
+	fields := strings.Fields(comment)
+	if len(fields) == 0 {
+		return false
+	}
+	svc := fields[0]
+
+	port := ""
+	if i := strings.Index(svc, ":"); i >= 0 {
+		svc, port = svc[:i], svc[i+1:]
+	}
+	if svc != sel.namespace+"/"+sel.name {
+		return false
+	}
+	return sel.anyPort || port == sel.port
+}
+
+func matchesAnySelector(sels []serviceSelector, comment string) bool {
+	for _, sel := range sels {
+		if sel.matches(comment) {
+			return true
+		}
+	}
+	return false
 }
 
-func ensureLinkingChains(ipt utiliptables.Interface) error {
-	if _, err := ipt.EnsureChain(utiliptables.TableNAT, kubeServicesChain); err != nil {
-		log.Printf("Failed to ensure that %s chain %s exists: %v", utiliptables.TableNAT, kubeServicesChain, err)
-		return err
-	}
-
-	tableChainsNeedJumpServices := []struct {
-		table utiliptables.Table
-		chain utiliptables.Chain
-	}{
-		{utiliptables.TableNAT, utiliptables.ChainOutput},
-		{utiliptables.TableNAT, utiliptables.ChainPrerouting},
-	}
-	comment := "kubernetes service portals"
-	args := []string{"-m", "comment", "--comment", comment, "-j", string(kubeServicesChain)}
-	for _, tc := range tableChainsNeedJumpServices {
-		if _, err := ipt.EnsureRule(utiliptables.Prepend, tc.table, tc.chain, args...); err != nil {
-			log.Printf("Failed to ensure that %s chain %s jumps to %s: %v", tc.table, tc.chain, kubeServicesChain, err)
-			return err
+// getSelectedTableLines returns the lines of the given table for the services
+// selected by the given selectors: their rules in the per service chains of
+// the table, like the services and nodeports chains, and the chains those
+// rules jump to, directly or indirectly, like the KUBE-SVC-*, KUBE-SEP-* and
+// marking chains. The shared chains of the table, like the kubernetes
+// postrouting chain, are kept as well.
+func getSelectedTableLines(table utiliptables.Table, save []byte, sels []serviceSelector) ([]byte, error) {
+	kt := kubeTables[table]
+	t, err := parseTable(table, save)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		// nothing to checkpoint
+		return nil, nil
+	}
+
+	// the rules selected in the per service chains are the roots
+	chains := map[utiliptables.Chain]bool{}
+	roots := map[int]bool{}
+	rootChains := append([]utiliptables.Chain(nil), kt.sharedChains...)
+	for i, r := range t.rules {
+		if !kt.serviceChains[r.chain] {
+			continue
+		}
+		if !matchesAnySelector(sels, r.comment()) {
+			continue
 		}
+		roots[i] = true
+		chains[r.chain] = true
+		rootChains = append(rootChains, utiliptables.Chain(r.target()))
 	}
 
-	// Create and link the kube postrouting chain.
-	if _, err := ipt.EnsureChain(utiliptables.TableNAT, kubePostroutingChain); err != nil {
-		log.Printf("Failed to ensure that %s chain %s exists: %v", utiliptables.TableNAT, kubePostroutingChain, err)
-		return err
+	keep := t.closure(rootChains)
+
+	var rules []iptablesRule
+	for i, r := range t.rules {
+		if roots[i] || (keep[r.chain] && !chains[r.chain]) {
+			rules = append(rules, r)
+		}
+	}
+	for c := range keep {
+		chains[c] = true
 	}
 
-	comment = "kubernetes postrouting rules"
-	args = []string{"-m", "comment", "--comment", comment, "-j", string(kubePostroutingChain)}
-	if _, err := ipt.EnsureRule(utiliptables.Prepend, utiliptables.TableNAT, utiliptables.ChainPostrouting, args...); err != nil {
-		log.Printf("Failed to ensure that %s chain %s jumps to %s: %v", utiliptables.TableNAT, utiliptables.ChainPostrouting, kubePostroutingChain, err)
-		return err
+	if err = validate(chains, rules); err != nil {
+		return nil, err
 	}
+	return t.bytes(chains, rules), nil
+}
 
+// ensureLinkingChains ensures the kube-proxy chains of the given tables exist
+// and are linked to the top level chains.
+func ensureLinkingChains(ipt utiliptables.Interface, tables []utiliptables.Table) error {
+	for _, table := range tables {
+		for _, l := range kubeTables[table].links {
+			if _, err := ipt.EnsureChain(table, l.target); err != nil {
+				log.Printf("Failed to ensure that %s chain %s exists: %v", table, l.target, err)
+				return err
+			}
+			if _, err := ipt.EnsureRule(utiliptables.Prepend, table, l.chain, l.args()...); err != nil {
+				log.Printf("Failed to ensure that %s chain %s jumps to %s: %v", table, l.chain, l.target, err)
+				return err
+			}
+		}
+	}
 	return nil
 }
@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"testing"
+
+	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
 )
 
 func TestGetKubeNATTableLine(t *testing.T) {
-	got, err := getKubeNATTableLines(exampleTables)
+	got, err := getKubeTableLines(utiliptables.TableNAT, exampleTables, chainProfiles[defaultChainProfile])
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -17,3 +19,256 @@ func TestGetKubeNATTableLine(t *testing.T) {
 		t.Error(string(got))
 	}
 }
+
+func TestGetSelectedNATTableLines(t *testing.T) {
+	sels, err := parseServiceSelectors("kube-system/kube-dns:dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := getSelectedTableLines(utiliptables.TableNAT, exampleTables, sels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte(`*nat
+:KUBE-MARK-MASQ - [0:0]
+:KUBE-POSTROUTING - [0:0]
+:KUBE-SEP-5QBP3MZSYLBKSV52 - [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-TCOU7JCQXEZGVUNU - [0:0]
+-A KUBE-MARK-MASQ -j MARK --set-xmark 0x4000/0x4000
+-A KUBE-POSTROUTING -m comment --comment "kubernetes service traffic requiring SNAT" -m mark --mark 0x4000/0x4000 -j MASQUERADE
+-A KUBE-SEP-5QBP3MZSYLBKSV52 -s 10.216.4.2/32 -m comment --comment "kube-system/kube-dns:dns" -j KUBE-MARK-MASQ
+-A KUBE-SEP-5QBP3MZSYLBKSV52 -p udp -m comment --comment "kube-system/kube-dns:dns" -m udp -j DNAT --to-destination 10.216.4.2:53
+-A KUBE-SERVICES ! -s 10.216.0.0/14 -d 10.219.240.10/32 -p udp -m comment --comment "kube-system/kube-dns:dns cluster IP" -m udp --dport 53 -j KUBE-MARK-MASQ
+-A KUBE-SERVICES -d 10.219.240.10/32 -p udp -m comment --comment "kube-system/kube-dns:dns cluster IP" -m udp --dport 53 -j KUBE-SVC-TCOU7JCQXEZGVUNU
+-A KUBE-SVC-TCOU7JCQXEZGVUNU -m comment --comment "kube-system/kube-dns:dns" -j KUBE-SEP-5QBP3MZSYLBKSV52
+COMMIT
+`)
+	if !bytes.Equal(got, want) {
+		t.Error("got wrong table")
+		t.Error(string(want))
+		t.Error(string(got))
+	}
+}
+
+func TestServiceSelectorMatches(t *testing.T) {
+	testCases := []struct {
+		selector string
+		comment  string
+		want     bool
+	}{
+		{"kube-system/kube-dns", "kube-system/kube-dns:dns-tcp cluster IP", true},
+		{"kube-system/kube-dns:dns", "kube-system/kube-dns:dns-tcp cluster IP", false},
+		{"kube-system/kube-dns:dns", "kube-system/kube-dns:dns", true},
+		{"kube-system/heapster:", "kube-system/heapster: cluster IP", true},
+		{"kube-system/heapster", "kube-system/heapster-canary: cluster IP", false},
+		{"default/kubernetes", "kubernetes service nodeports; NOTE: this must be the last rule in this chain", false},
+	}
+
+	for _, tc := range testCases {
+		sels, err := parseServiceSelectors(tc.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sels[0].matches(tc.comment); got != tc.want {
+			t.Errorf("selector %q on comment %q: expected %v, got %v", tc.selector, tc.comment, tc.want, got)
+		}
+	}
+
+	for _, invalid := range []string{"kube-etcd", "/kube-etcd", "kube-system/", "a/b/c"} {
+		if _, err := parseServiceSelectors(invalid); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestGetKubeNATTableLinesClosure(t *testing.T) {
+	save := []byte(`*nat
+:PREROUTING ACCEPT [0:0]
+:OUTPUT ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-ETCD - [0:0]
+:KUBE-SEP-ETCD - [0:0]
+:KUBE-SVC-ORPHAN - [0:0]
+-A PREROUTING -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A OUTPUT -m comment --comment "kubernetes service portals" -j KUBE-SERVICES
+-A KUBE-SERVICES -d 10.3.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-ETCD
+-A KUBE-SVC-ETCD -m comment --comment "kube-system/kube-etcd:client" -j KUBE-SEP-ETCD
+-A KUBE-SEP-ETCD -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.2.0.4:2379
+-A KUBE-SVC-ORPHAN -m comment --comment "default/orphan:" -j KUBE-SEP-GONE
+COMMIT
+`)
+
+	got, err := getKubeTableLines(utiliptables.TableNAT, save, chainProfiles[defaultChainProfile])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte(`*nat
+:KUBE-SERVICES - [0:0]
+:KUBE-SVC-ETCD - [0:0]
+:KUBE-SEP-ETCD - [0:0]
+-A KUBE-SERVICES -d 10.3.0.15/32 -p tcp -m comment --comment "kube-system/kube-etcd:client cluster IP" -m tcp --dport 2379 -j KUBE-SVC-ETCD
+-A KUBE-SVC-ETCD -m comment --comment "kube-system/kube-etcd:client" -j KUBE-SEP-ETCD
+-A KUBE-SEP-ETCD -p tcp -m comment --comment "kube-system/kube-etcd:client" -m tcp -j DNAT --to-destination 10.2.0.4:2379
+COMMIT
+`)
+	if !bytes.Equal(got, want) {
+		t.Error("got wrong table")
+		t.Error(string(want))
+		t.Error(string(got))
+	}
+
+	// a reachable rule jumping to an undefined chain is rejected
+	broken := bytes.Replace(save, []byte(":KUBE-SEP-ETCD - [0:0]\n"), nil, 1)
+	if _, err = getKubeTableLines(utiliptables.TableNAT, broken, chainProfiles[defaultChainProfile]); err == nil {
+		t.Error("expected failure for undefined chain")
+	}
+}
+
+func TestGetKubeNATTableLinesProfiles(t *testing.T) {
+	tests := []struct {
+		profile string
+		save    []byte
+		want    []string
+		notWant []string
+	}{
+		{
+			profile: "v1.6",
+			save:    exampleTablesV124,
+			want:    []string{"KUBE-SERVICES", "KUBE-EXT-GNZBNJ2PO5MGZ6GT", "KUBE-MARK-DROP"},
+			notWant: []string{"KUBE-PROXY-CANARY", "KUBE-KUBELET-CANARY", "CNI-HOSTPORT-DNAT"},
+		},
+		{
+			profile: "v1.24",
+			save:    exampleTablesV124,
+			want:    []string{"KUBE-SERVICES", "KUBE-EXT-GNZBNJ2PO5MGZ6GT", "KUBE-MARK-DROP", "KUBE-PROXY-CANARY", "KUBE-KUBELET-CANARY"},
+			notWant: []string{"CNI-HOSTPORT-DNAT"},
+		},
+		{
+			profile: "v1.28",
+			save:    exampleTablesV128,
+			want:    []string{"KUBE-SERVICES", "KUBE-EXT-7EJNTS7AENER2WX5", "KUBE-SVL-7EJNTS7AENER2WX5", "KUBE-PROXY-CANARY", "KUBE-KUBELET-CANARY"},
+			notWant: []string{"KUBE-MARK-DROP"},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := getKubeTableLines(utiliptables.TableNAT, tt.save, chainProfiles[tt.profile])
+		if err != nil {
+			t.Errorf("%s: %v", tt.profile, err)
+			continue
+		}
+		for _, c := range tt.want {
+			if !bytes.Contains(got, []byte("\n:"+c+" ")) {
+				t.Errorf("%s: expected chain %s to be kept", tt.profile, c)
+			}
+		}
+		for _, c := range tt.notWant {
+			if bytes.Contains(got, []byte(c)) {
+				t.Errorf("%s: expected chain %s to be dropped", tt.profile, c)
+			}
+		}
+	}
+}
+
+func TestLoadChainPatterns(t *testing.T) {
+	ps, err := loadChainPatterns("none", "global:KUBE-SERVICES, prefix:KUBE-SVC-,regex:^KUBE-SEP-[A-Z0-9]+$", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []utiliptables.Chain{"KUBE-SERVICES", "KUBE-SVC-ABC", "KUBE-SEP-ABC"} {
+		if !ps.isKubeChain(c) {
+			t.Errorf("expected %s to match", c)
+		}
+	}
+	for _, c := range []utiliptables.Chain{"KUBE-SERVICES-X", "KUBE-SEP-abc", "CNI-HOSTPORT-DNAT"} {
+		if ps.isKubeChain(c) {
+			t.Errorf("expected %s not to match", c)
+		}
+	}
+	if !ps.isGlobalChain("KUBE-SERVICES") || ps.isGlobalChain("KUBE-SVC-ABC") {
+		t.Error("got wrong global chains")
+	}
+
+	for _, tt := range []struct{ profile, patterns string }{
+		{"v0.1", ""},
+		{"none", ""},
+		{"none", "KUBE-SERVICES"},
+		{"none", "suffix:-CANARY"},
+		{"none", "regex:("},
+	} {
+		if _, err := loadChainPatterns(tt.profile, tt.patterns, ""); err == nil {
+			t.Errorf("expected failure for profile %q and patterns %q", tt.profile, tt.patterns)
+		}
+	}
+}
+
+func TestGetKubeFilterTableLines(t *testing.T) {
+	got, err := getKubeTableLines(utiliptables.TableFilter, exampleFilterTablesV124, chainProfiles["v1.24"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte(`*filter
+:KUBE-EXTERNAL-SERVICES - [0:0]
+:KUBE-FIREWALL - [0:0]
+:KUBE-FORWARD - [0:0]
+:KUBE-KUBELET-CANARY - [0:0]
+:KUBE-NODEPORTS - [0:0]
+:KUBE-PROXY-CANARY - [0:0]
+:KUBE-SERVICES - [0:0]
+-A KUBE-EXTERNAL-SERVICES -p tcp -m comment --comment "default/idle:http has no endpoints" -m addrtype --dst-type LOCAL -m tcp --dport 30081 -j REJECT --reject-with icmp-port-unreachable
+-A KUBE-FIREWALL -m comment --comment "kubernetes firewall for dropping marked packets" -m mark --mark 0x8000/0x8000 -j DROP
+-A KUBE-FIREWALL ! -s 127.0.0.0/8 -d 127.0.0.0/8 -m comment --comment "block incoming localnet connections" -m conntrack ! --ctstate RELATED,ESTABLISHED,DNAT -j DROP
+-A KUBE-FORWARD -m conntrack --ctstate INVALID -j DROP
+-A KUBE-FORWARD -m comment --comment "kubernetes forwarding rules" -m mark --mark 0x4000/0x4000 -j ACCEPT
+-A KUBE-FORWARD -m comment --comment "kubernetes forwarding conntrack rule" -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A KUBE-SERVICES -d 10.96.87.201/32 -p tcp -m comment --comment "default/idle:http has no endpoints" -m tcp --dport 80 -j REJECT --reject-with icmp-port-unreachable
+COMMIT
+`)
+	if !bytes.Equal(got, want) {
+		t.Error("got wrong filter table")
+		t.Error(string(want))
+		t.Error(string(got))
+	}
+
+	// the filter table has no rules of the etcd service, only the
+	// forwarding and firewall chains are kept
+	sels, err := parseServiceSelectors("kube-system/kube-etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = getSelectedTableLines(utiliptables.TableFilter, exampleFilterTablesV124, sels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []string{"KUBE-FORWARD", "KUBE-FIREWALL"} {
+		if !bytes.Contains(got, []byte("\n:"+c+" ")) {
+			t.Errorf("expected chain %s to be kept", c)
+		}
+	}
+	for _, c := range []string{"KUBE-SERVICES", "KUBE-EXTERNAL-SERVICES", "DOCKER-USER"} {
+		if bytes.Contains(got, []byte(c)) {
+			t.Errorf("expected chain %s to be dropped", c)
+		}
+	}
+}
+
+func TestParseIptablesTables(t *testing.T) {
+	tables, err := parseIptablesTables("nat, filter,nat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 || tables[0] != utiliptables.TableNAT || tables[1] != utiliptables.TableFilter {
+		t.Errorf("got wrong tables: %v", tables)
+	}
+
+	for _, s := range []string{"", "mangle", "nat,raw"} {
+		if _, err := parseIptablesTables(s); err == nil {
+			t.Errorf("expected failure for %q", s)
+		}
+	}
+}
@@ -4,20 +4,24 @@ import (
 	"flag"
 	"log"
 	"os"
-	"path"
 	"time"
 
 	utildbus "github.com/coreos/kenc/pkg/util/dbus"
 	utilexec "github.com/coreos/kenc/pkg/util/exec"
+	utilipset "github.com/coreos/kenc/pkg/util/ipset"
 	utiliptables "github.com/coreos/kenc/pkg/util/iptables"
+	utilipvs "github.com/coreos/kenc/pkg/util/ipvs"
+	utilnftables "github.com/coreos/kenc/pkg/util/nftables"
 
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	modeEndpointsCheckpoint = "endpoints"
 	modeIptablesCheckpoint  = "iptables"
+	modeIPVSCheckpoint      = "ipvs"
 
 	dirperm = 0700
 
@@ -27,135 +31,299 @@ const (
 )
 
 var (
-	mode               string
-	r                  bool
-	vip                string
-	checkpointDir      string
-	checkpointInterval time.Duration
-
-	// global iptables utility
-	ipt utiliptables.Interface
+	configFile           string
+	kubeconfig           string
+	master               string
+	kubeletKubeconfig    string
+	configReloadInterval time.Duration
+	mode                 string
+	r                    bool
+	checkpointersFlag    string
+	checkpointIntervals  string
+	fallback             bool
+	vip                  string
+	vip6                 string
+	checkpointDir        string
+	checkpointInterval   time.Duration
+	checkpointRetention  int
+	datapath             string
+	iptablesMode         string
+	endpointsIPSet       bool
+	iptablesServices     string
+	iptablesTables       string
+	kubeProxyProfile     string
+	chainPatternsFlag    string
+	chainPatternsFile    string
+	hostsDir             string
+	hostsFile            string
+	hostsInterval        time.Duration
+	hostsEnabled         bool
+	hostsManagedBlock    bool
+	hostsSRVFile         string
+	clusterDomain        string
+	dnsAddr              string
+	etcdSource           string
+	etcdCAFile           string
+	etcdCertFile         string
+	etcdKeyFile          string
+	healthCheckInterval  time.Duration
+	healthCheckTimeout   time.Duration
+	healthCheckEtcd      bool
+	healthCheckFall      int
+	healthCheckRise      int
+	dnsUpstream          string
+	etcdSelector         string
+	etcdNamespace        string
+	etcdService          string
+	etcdClientPort       int
+
+	// the rules checkpointed in iptables mode
+	iptSelection iptablesSelection
+
+	// global iptables utilities. ip6t is nil unless an IPv6 etcd
+	// service ip is given.
+	ipt  utiliptables.Interface
+	ip6t utiliptables.Interface
+	// global nftables utility
+	nft utilnftables.Interface
+	// global ipvs utility
+	ipvs utilipvs.Interface
+	// global ipset utility
+	ipset utilipset.Interface
 )
 
 func init() {
-	flag.StringVar(&mode, "m", modeIptablesCheckpoint, "kubernetes etcd netowrk checkpint mode (endpoints/iptables)")
+	flag.StringVar(&configFile, "config", "", "the YAML or JSON configuration file; flags override its settings, reloaded on SIGHUP")
+	flag.DurationVar(&configReloadInterval, "config-reload-interval", 0, "the time interval to check the configuration file for changes; 0 only reloads on SIGHUP")
+	flag.StringVar(&mode, "m", modeIptablesCheckpoint, "kubernetes etcd netowrk checkpint mode (endpoints/iptables/ipvs)")
 	flag.BoolVar(&r, "r", false, "network recovery only")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "the kubeconfig file to run out of cluster")
+	flag.StringVar(&master, "master", "", "the address of the kubernetes API server, overrides the server of the kubeconfig")
+	flag.StringVar(&kubeletKubeconfig, "kubelet-kubeconfig", "", "the kubelet kubeconfig file to run out of cluster on a node, e.g. /etc/kubernetes/kubelet.conf; used if neither -kubeconfig nor -master is given")
+	flag.StringVar(&etcdSource, "etcd-source", etcdSourcePods, "where the endpoints and hosts checkpointers read the etcd members from: the etcd pods or the ready endpoints of the kube-etcd service, or the member list of the current endpoints for the endpoints checkpointer (pods/endpoints/endpointslices/members)")
+	flag.StringVar(&etcdCAFile, "etcd-ca-file", "", "the CA file verifying the etcd members with -etcd-source=members; enables https")
+	flag.StringVar(&etcdCertFile, "etcd-cert-file", "", "the client certificate file of -etcd-source=members; enables https")
+	flag.StringVar(&etcdKeyFile, "etcd-key-file", "", "the client key file of -etcd-source=members")
+	flag.StringVar(&checkpointersFlag, "checkpointers", "", "comma separated checkpointers to run concurrently (endpoints/iptables/ipvs/hosts); the -m mode and, unless -hosts=false, hosts if empty")
+	flag.StringVar(&checkpointIntervals, "checkpoint-intervals", "", "comma separated <checkpointer>=<duration> intervals overriding -checkpoint-interval and -hosts-interval")
+	flag.BoolVar(&fallback, "fallback", false, "with -r, keep running: install the checkpoint while kube-proxy has not programmed the etcd service ip and remove it once it has (endpoints/iptables checkpointers)")
 	flag.StringVar(&vip, "etcd-service-ip", defaultVIP, "the kuberentes service ip of the etcd cluster")
+	flag.StringVar(&vip6, "etcd-service-ip6", "", "the kuberentes IPv6 service ip of the etcd cluster; enables IPv6 checkpointing when set")
+	flag.StringVar(&etcdSelector, "etcd-selector", defaultEtcdSelector, "the label selector of the etcd pods")
+	flag.StringVar(&etcdNamespace, "etcd-namespace", defaultEtcdNamespace, "the namespace of the etcd pods and service")
+	flag.StringVar(&etcdService, "etcd-service", defaultEtcdService, "the name of the etcd service")
+	flag.IntVar(&etcdClientPort, "etcd-client-port", defaultClientPort, "the client port of the etcd members")
 	flag.StringVar(&checkpointDir, "checkpoint-dir", defaultCheckpointDir, "the directory to store/restore checkpoints")
 	flag.DurationVar(&checkpointInterval, "checkpoint-interval", defaultClusterInteval, "the time interval to take checkpoints")
-	flag.Parse()
-
-	ipt = utiliptables.New(utilexec.New(), utildbus.New(), utiliptables.ProtocolIpv4)
+	flag.IntVar(&checkpointRetention, "checkpoint-retention", 0, "the number of previous endpoints, iptables and ipvs checkpoints to keep as <file>.1 to <file>.N")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", 0, "the time interval to probe the checkpointed etcd endpoints in endpoints mode, ejecting the failing ones from the datapath; disabled if 0")
+	flag.DurationVar(&healthCheckTimeout, "health-check-timeout", defaultHealthCheckTimeout, "the timeout of an etcd endpoint probe")
+	flag.BoolVar(&healthCheckEtcd, "health-check-etcd", false, "also probe the /health endpoint of the etcd members, with the -etcd-*-file TLS files")
+	flag.IntVar(&healthCheckFall, "health-check-fall", defaultHealthCheckFall, "the consecutive failed probes ejecting an etcd endpoint")
+	flag.IntVar(&healthCheckRise, "health-check-rise", defaultHealthCheckRise, "the consecutive successful probes readmitting an ejected etcd endpoint")
+	flag.StringVar(&datapath, "datapath", datapathIptables, "the datapath used to forward etcd traffic in endpoints mode (iptables/nftables)")
+	flag.BoolVar(&endpointsIPSet, "endpoints-ipset", false, "keep the etcd endpoints in an ipset and only rewrite the iptables datapath when its members change")
+	flag.StringVar(&iptablesServices, "iptables-services", "", "comma separated namespace/name[:port] services to checkpoint in iptables mode; all services if empty")
+	flag.StringVar(&iptablesTables, "iptables-tables", string(utiliptables.TableNAT), "comma separated tables to checkpoint in iptables mode (nat/filter)")
+	flag.StringVar(&kubeProxyProfile, "kube-proxy-profile", defaultChainProfile, "the kube-proxy version whose chains are checkpointed in iptables mode (v1.6/v1.24/v1.28/none)")
+	flag.StringVar(&chainPatternsFlag, "iptables-chain-patterns", "", "comma separated global:<chain>, prefix:<prefix> or regex:<regex> patterns of additional kube-proxy chains")
+	flag.StringVar(&chainPatternsFile, "iptables-chain-patterns-file", "", "file with additional kube-proxy chain patterns, one per line")
+	flag.BoolVar(&hostsEnabled, "hosts", true, "run the hosts checkpointer with the -m mode checkpointer when -checkpointers is empty")
+	flag.StringVar(&hostsDir, "hosts-dir", etcdDir, "the directory to store the etcd hosts checkpoint")
+	flag.StringVar(&hostsFile, "hosts-file", "", "the etcd hosts checkpoint file; "+etcdHostsFilename+" in -hosts-dir if empty")
+	flag.BoolVar(&hostsManagedBlock, "hosts-managed-block", false, "maintain the etcd hosts in a kenc managed block of -hosts-file, e.g. /etc/hosts, keeping the lines outside of it")
+	flag.StringVar(&hostsSRVFile, "hosts-srv-file", "", "the file to write the etcd SRV records of the hosts checkpoint to, as a zone file fragment; disabled if empty")
+	flag.DurationVar(&hostsInterval, "hosts-interval", defaultHostsInterval, "the time interval to checkpoint the etcd hosts, unless given by -checkpoint-intervals")
+	flag.StringVar(&dnsAddr, "dns-addr", "", "the local UDP address to answer DNS queries for the etcd names from the hosts checkpoint on, e.g. 127.0.0.1:5353; disabled if empty")
+	flag.StringVar(&dnsUpstream, "dns-upstream", "", "the host:port of the DNS server to forward the other queries to; refused if empty")
+	flag.StringVar(&clusterDomain, "cluster-domain", defaultClusterDomain, "the DNS domain of the kubernetes cluster")
+	flag.StringVar(&iptablesMode, "iptables-mode", string(utiliptables.ModeAuto), "the iptables variant to use; auto picks the one holding the kube-proxy rules (auto/legacy/nft/default)")
 }
 
 func main() {
-	err := os.MkdirAll(checkpointDir, dirperm)
-	if err != nil {
-		log.Fatalf("failed to create checkpoint dir: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == cmdEtcdFlags {
+		if err := runEtcdFlags(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	go func() {
-		for {
-			time.Sleep(10 * time.Second)
-			// Just don't let it fail if it couldn't new client.
-			// Because we have another routine checkpointing other stuff (e.g. iptables).
-			// Better separate into two programs.
-			cfg, err := rest.InClusterConfig()
-			if err != nil {
-				log.Print(err)
-				continue
-			}
-			kubecli, err := kubernetes.NewForConfig(cfg)
-			if err != nil {
-				log.Print(err)
-				continue
-			}
+	flag.Parse()
 
-			runHostsCheckpointer(kubecli)
+	var err error
+	given := givenFlags(flag.CommandLine)
+	if configFile != "" {
+		err = loadConfigFile(flag.CommandLine, configFile)
+		if err != nil {
+			log.Fatalf("invalid config: %v", err)
 		}
-	}()
+	}
+
+	if err = parseEtcdSource(etcdSource); err != nil {
+		log.Fatalf("invalid -etcd-source: %v", err)
+	}
+	if err = validateEtcdSelection(etcdSelector, etcdNamespace, etcdService, etcdClientPort); err != nil {
+		log.Fatalf("invalid etcd selection: %v", err)
+	}
+	if checkpointRetention < 0 {
+		log.Fatal("-checkpoint-retention must not be negative")
+	}
+	if (etcdCertFile != "") != (etcdKeyFile != "") {
+		log.Fatal("-etcd-cert-file and -etcd-key-file must be given together")
+	}
+	if err = validateHealthCheck(healthCheckInterval, healthCheckTimeout, healthCheckFall, healthCheckRise); err != nil {
+		log.Fatalf("invalid health check: %v", err)
+	}
 
-	switch mode {
-	case modeEndpointsCheckpoint:
-		runEndpointsMode()
-	case modeIptablesCheckpoint:
-		runIptablesMode()
+	settings, err := newReloadableSettings(flagValues(flag.CommandLine))
+	if err != nil {
+		log.Fatal(err)
+	}
+	settings.apply()
+
+	iptMode := utiliptables.Mode(iptablesMode)
+	switch iptMode {
+	case utiliptables.ModeDefault, utiliptables.ModeAuto, utiliptables.ModeLegacy, utiliptables.ModeNFT:
 	default:
-		log.Fatalf("unknown mode: %v", mode)
+		log.Fatalf("unknown iptables mode: %v", iptablesMode)
 	}
-}
 
-func runEndpointsMode() {
-	if r {
-		err := writeRouteRule(ipt, vip)
+	ipt = utiliptables.NewWithMode(utilexec.New(), utildbus.New(), utiliptables.ProtocolIpv4, iptMode)
+	if vip6 != "" {
+		ip6t = utiliptables.NewWithMode(utilexec.New(), utildbus.New(), utiliptables.ProtocolIpv6, iptMode)
+	}
+	nft = utilnftables.New(utilexec.New())
+	ipvs = utilipvs.New(utilexec.New())
+	ipset = utilipset.New(utilexec.New())
+
+	err = os.MkdirAll(checkpointDir, dirperm)
+	if err != nil {
+		log.Fatalf("failed to create checkpoint dir: %v", err)
+	}
+
+	names, err := parseCheckpointers(checkpointersFlag, mode, hostsEnabled)
+	if err != nil {
+		log.Fatalf("invalid -checkpointers: %v", err)
+	}
+	var cps []checkpointer
+	for _, name := range names {
+		c, err := newCheckpointer(name)
 		if err != nil {
-			log.Fatalf("cannot write route rule for checkpoint: %v", err)
+			log.Fatal(err)
 		}
+		if err = c.setup(); err != nil {
+			log.Fatal(err)
+		}
+		cps = append(cps, c)
+	}
 
-		eps, err := getEndpointsFromCheckpoint()
+	if dnsAddr != "" && (!r || fallback) {
+		s, err := newDNSServer(dnsAddr, dnsUpstream, hostsCheckpoint)
 		if err != nil {
-			if !os.IsNotExist(err) {
-				log.Fatalf("cannot open endpoints checkpoint file: %v", err)
-			}
-		} else {
-			err = writeNatTableRule(ipt, vip, eps)
-			if err != nil {
-				log.Fatalf("cannot setup iptable rules for recovery: %v", err)
-			}
+			log.Fatalf("failed to listen for DNS queries: %v", err)
 		}
-		os.Exit(0)
+		go func() {
+			log.Fatalf("DNS server failed: %v", s.serve())
+		}()
 	}
 
-	cp := newEndpointCheckpointer(mustNewKubeClient())
-
-	ticker := time.NewTicker(checkpointInterval)
-
-	for {
-		select {
-		case <-ticker.C:
-			err := cp.checkpoint()
+	if r && fallback {
+		var routings fallbackRoutings
+		for _, c := range cps {
+			routing, err := c.fallbackRouting()
 			if err != nil {
-				log.Printf("failed to checkpoint etcd endpoints: %v", err)
+				log.Fatal(err)
 			}
-			err = writeNatTableRule(ipt, vip, cp.endpoints)
-			if err != nil {
-				log.Printf("failed to update iptable rules: %v", err)
+			if routing != nil {
+				routings = append(routings, routing)
 			}
 		}
+		runFallback(routings)
+	}
+
+	if r {
+		// restore in recovery order
+		for _, c := range cps {
+			if err = c.restore(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		os.Exit(0)
+	}
+
+	for i, c := range cps {
+		go runCheckpointer(names[i], c)
 	}
+	if configFile != "" {
+		go watchConfigFile(flag.CommandLine, configFile, given, configReloadInterval)
+	}
+	select {}
 }
 
-func runIptablesMode() {
-	err := ensureLinkingChains(ipt)
+// newEndpointsDatapaths returns the endpoints datapath for each enabled
+// address family.
+func newEndpointsDatapaths() ([]endpointsDatapath, error) {
+	dp, err := newEndpointsDatapath(datapath, false, vip)
 	if err != nil {
-		log.Fatalf("failed to ensure iptables chains: %v", err)
+		return nil, err
 	}
+	dps := []endpointsDatapath{dp}
 
-	if r {
-		err := restoreIPtablesFromFile(ipt, path.Join(checkpointDir, iptablesCheckpointFile))
-		if err != nil && !os.IsNotExist(err) {
-			log.Fatalf("failed to restore iptables: %v", err)
+	if vip6 != "" {
+		dp, err = newEndpointsDatapath(datapath, true, vip6)
+		if err != nil {
+			return nil, err
 		}
-		os.Exit(0)
+		dps = append(dps, dp)
 	}
+	return dps, nil
+}
 
-	ticker := time.NewTicker(checkpointInterval)
+// syncEndpoints splits the given endpoints by address family and syncs
+// them to the datapath of the same family.
+func syncEndpoints(dps []endpointsDatapath, endpoints []string) error {
+	eps4, eps6 := splitEndpointsByFamily(endpoints)
 
-	for {
-		select {
-		case <-ticker.C:
-			err := saveIPtables(ipt, checkpointDir, iptablesCheckpointFile)
-			if err != nil {
-				log.Printf("failed to save iptables: %v", err)
-			}
+	for _, dp := range dps {
+		eps := eps4
+		if dp.isIPv6() {
+			eps = eps6
+		}
+		err := dp.syncEndpoints(eps)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
 }
 
 func mustNewKubeClient() kubernetes.Interface {
-	cfg, err := rest.InClusterConfig()
+	kubecli, err := newKubeClient()
 	if err != nil {
 		log.Fatal(err)
 	}
-	return kubernetes.NewForConfigOrDie(cfg)
+	return kubecli
+}
+
+// newKubeClient returns a client of the configured cluster.
+func newKubeClient() (kubernetes.Interface, error) {
+	cfg, err := newKubeConfig(kubeconfig, master, kubeletKubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(cfg)
+}
+
+// newKubeConfig returns the client config of the given kubeconfig and
+// master, if any is given, else of the given kubelet kubeconfig, if given,
+// else the in-cluster config.
+func newKubeConfig(kubeconfig, master, kubeletKubeconfig string) (*rest.Config, error) {
+	switch {
+	case kubeconfig != "" || master != "":
+		return clientcmd.BuildConfigFromFlags(master, kubeconfig)
+	case kubeletKubeconfig != "":
+		return clientcmd.BuildConfigFromFlags("", kubeletKubeconfig)
+	default:
+		return rest.InClusterConfig()
+	}
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+const exampleKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: local
+  cluster:
+    server: https://10.0.0.1:443
+users:
+- name: kubelet
+  user:
+    token: secret
+contexts:
+- name: kubelet
+  context:
+    cluster: local
+    user: kubelet
+current-context: kubelet
+`
+
+func TestNewKubeConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := path.Join(dir, "kubeconfig")
+	if err = ioutil.WriteFile(kubeconfig, []byte(exampleKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		kubeconfig        string
+		master            string
+		kubeletKubeconfig string
+		host              string
+	}{
+		{kubeconfig: kubeconfig, host: "https://10.0.0.1:443"},
+		{kubeconfig: kubeconfig, master: "https://10.0.0.2:443", host: "https://10.0.0.2:443"},
+		{master: "http://127.0.0.1:8080", host: "http://127.0.0.1:8080"},
+		{kubeletKubeconfig: kubeconfig, host: "https://10.0.0.1:443"},
+		{master: "http://127.0.0.1:8080", kubeletKubeconfig: kubeconfig, host: "http://127.0.0.1:8080"},
+	}
+	for i, tt := range tests {
+		cfg, err := newKubeConfig(tt.kubeconfig, tt.master, tt.kubeletKubeconfig)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if cfg.Host != tt.host {
+			t.Errorf("#%d: got wrong host, want=%s, got=%s", i, tt.host, cfg.Host)
+		}
+	}
+
+	if _, err = newKubeConfig(path.Join(dir, "missing"), "", ""); err == nil {
+		t.Error("expected an error for a missing kubeconfig")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+
+	utilnftables "github.com/coreos/kenc/pkg/util/nftables"
+)
+
+const (
+	// the nftables table owned by kenc
+	kencTable = "kenc"
+	// the map from the etcd service ip and port to the etcd chain
+	etcdVIPMap = "etcd-vips"
+	// the chain load balancing to the etcd endpoints
+	nftEtcdChain = "self-hosted-etcd"
+
+	nftNATPriority = -100
+)
+
+// nftablesDatapath implements endpointsDatapath with a kenc owned nftables
+// table. The whole table is replaced in a single `nft -f` transaction on
+// every sync, so there are never partially written rules.
+type nftablesDatapath struct {
+	nft    utilnftables.Interface
+	family utilnftables.Family
+	vip    string
+}
+
+// ensureRoute creates the kenc table without any endpoints if it does not
+// exist yet. The route is written together with the endpoints by syncEndpoints.
+func (d *nftablesDatapath) ensureRoute() error {
+	if _, err := d.nft.ListTable(d.family, kencTable); err == nil {
+		return nil
+	}
+	return d.syncEndpoints(nil)
+}
+
+// removeRoute deletes the kenc table.
+func (d *nftablesDatapath) removeRoute() error {
+	if _, err := d.nft.ListTable(d.family, kencTable); err != nil {
+		return nil
+	}
+	return d.nft.Apply([]byte(fmt.Sprintf("delete table %s %s\n", d.family, kencTable)))
+}
+
+func (d *nftablesDatapath) syncEndpoints(endpoints []string) error {
+	b, err := d.tableBytes(endpoints)
+	if err != nil {
+		return err
+	}
+	return d.nft.Apply(b)
+}
+
+func (d *nftablesDatapath) isIPv6() bool {
+	return d.family == utilnftables.FamilyIPv6
+}
+
+// tableBytes returns the `nft -f` payload that replaces the kenc table with
+// one forwarding the traffic sent to the service ip to one of the given
+// endpoints randomly.
+func (d *nftablesDatapath) tableBytes(endpoints []string) ([]byte, error) {
+	addrType, addrMatch := "ipv4_addr", "ip daddr"
+	if d.isIPv6() {
+		addrType, addrMatch = "ipv6_addr", "ip6 daddr"
+	}
+
+	var elements []string
+	for _, e := range endpoints {
+		host, port, err := net.SplitHostPort(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %v", e, err)
+		}
+		elements = append(elements, fmt.Sprintf("%d : %s . %s", len(elements), host, port))
+	}
+
+	var buf bytes.Buffer
+	// create the table first so that the delete never fails
+	fmt.Fprintf(&buf, "table %s %s {}\n", d.family, kencTable)
+	fmt.Fprintf(&buf, "delete table %s %s\n", d.family, kencTable)
+	fmt.Fprintf(&buf, "table %s %s {\n", d.family, kencTable)
+
+	fmt.Fprintf(&buf, "\tmap %s {\n", etcdVIPMap)
+	fmt.Fprintf(&buf, "\t\ttype %s . inet_service : verdict\n", addrType)
+	fmt.Fprintf(&buf, "\t\telements = { %s . %s : jump %s }\n", d.vip, clientPort(), nftEtcdChain)
+	fmt.Fprintf(&buf, "\t}\n")
+
+	for _, hook := range []string{"prerouting", "output"} {
+		fmt.Fprintf(&buf, "\tchain %s {\n", hook)
+		fmt.Fprintf(&buf, "\t\ttype nat hook %s priority %d; policy accept;\n", hook, nftNATPriority)
+		fmt.Fprintf(&buf, "\t\tct state new %s . tcp dport vmap @%s\n", addrMatch, etcdVIPMap)
+		fmt.Fprintf(&buf, "\t}\n")
+	}
+
+	fmt.Fprintf(&buf, "\tchain %s {\n", nftEtcdChain)
+	if len(elements) > 0 {
+		fmt.Fprintf(&buf, "\t\tdnat %s to numgen random mod %d map { %s }\n", d.family, len(elements), strings.Join(elements, ", "))
+	}
+	fmt.Fprintf(&buf, "\t}\n")
+	fmt.Fprintf(&buf, "}\n")
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+	utilnftables "github.com/coreos/kenc/pkg/util/nftables"
+)
+
+func TestNftablesDatapathSyncEndpoints(t *testing.T) {
+	fcmd := utilexec.FakeCmd{
+		CombinedOutputScript: []utilexec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte{}, nil },
+		},
+	}
+	fexec := utilexec.FakeExec{
+		CommandScript: []utilexec.FakeCommandAction{
+			func(cmd string, args ...string) utilexec.Cmd { return utilexec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	dp := &nftablesDatapath{
+		nft:    utilnftables.New(&fexec),
+		family: utilnftables.FamilyIPv4,
+		vip:    "10.3.0.15",
+	}
+
+	err := dp.syncEndpoints([]string{"10.2.0.4:2379", "10.2.0.5:2379"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadAll(fcmd.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `table ip kenc {}
+delete table ip kenc
+table ip kenc {
+	map etcd-vips {
+		type ipv4_addr . inet_service : verdict
+		elements = { 10.3.0.15 . 2379 : jump self-hosted-etcd }
+	}
+	chain prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		ct state new ip daddr . tcp dport vmap @etcd-vips
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ct state new ip daddr . tcp dport vmap @etcd-vips
+	}
+	chain self-hosted-etcd {
+		dnat ip to numgen random mod 2 map { 0 : 10.2.0.4 . 2379, 1 : 10.2.0.5 . 2379 }
+	}
+}
+`
+	if string(got) != want {
+		t.Errorf("got wrong nft payload")
+		t.Error(want)
+		t.Error(string(got))
+	}
+}
+
+func TestNftablesDatapathIPv6NoEndpoints(t *testing.T) {
+	dp := &nftablesDatapath{
+		family: utilnftables.FamilyIPv6,
+		vip:    "fd00:10:3::15",
+	}
+
+	got, err := dp.tableBytes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `table ip6 kenc {}
+delete table ip6 kenc
+table ip6 kenc {
+	map etcd-vips {
+		type ipv6_addr . inet_service : verdict
+		elements = { fd00:10:3::15 . 2379 : jump self-hosted-etcd }
+	}
+	chain prerouting {
+		type nat hook prerouting priority -100; policy accept;
+		ct state new ip6 daddr . tcp dport vmap @etcd-vips
+	}
+	chain output {
+		type nat hook output priority -100; policy accept;
+		ct state new ip6 daddr . tcp dport vmap @etcd-vips
+	}
+	chain self-hosted-etcd {
+	}
+}
+`
+	if string(got) != want {
+		t.Errorf("got wrong nft payload")
+		t.Error(want)
+		t.Error(string(got))
+	}
+}
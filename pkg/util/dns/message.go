@@ -0,0 +1,326 @@
+// Package dns provides a minimal DNS message codec for answering A, AAAA and
+// SRV queries.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource record types.
+const (
+	TypeA    uint16 = 1
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeANY  uint16 = 255
+
+	ClassINET uint16 = 1
+)
+
+// Response codes.
+const (
+	RcodeSuccess        uint8 = 0
+	RcodeFormatError    uint8 = 1
+	RcodeServerFailure  uint8 = 2
+	RcodeNameError      uint8 = 3
+	RcodeNotImplemented uint8 = 4
+	RcodeRefused        uint8 = 5
+)
+
+const (
+	headerLen = 12
+	// MaxUDPSize is the size of the largest message sent over UDP without
+	// EDNS.
+	MaxUDPSize = 512
+
+	maxPointers = 10
+)
+
+var errTruncated = errors.New("message truncated")
+
+// Question is a question of a message.
+type Question struct {
+	// Name is the fully qualified name, with a trailing dot.
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Resource is a resource record of a message.
+type Resource struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// Message is a DNS message. Only the question and answer sections are kept,
+// the authority and additional sections are ignored when parsing.
+type Message struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              uint8
+
+	Questions []Question
+	Answers   []Resource
+}
+
+// NewA returns an A record of the given IPv4 address.
+func NewA(name string, ip net.IP, ttl uint32) Resource {
+	return Resource{Name: name, Type: TypeA, Class: ClassINET, TTL: ttl, Data: []byte(ip.To4())}
+}
+
+// NewAAAA returns an AAAA record of the given IPv6 address.
+func NewAAAA(name string, ip net.IP, ttl uint32) Resource {
+	return Resource{Name: name, Type: TypeAAAA, Class: ClassINET, TTL: ttl, Data: []byte(ip.To16())}
+}
+
+// NewSRV returns an SRV record of the given target and port.
+func NewSRV(name string, priority, weight, port uint16, target string, ttl uint32) (Resource, error) {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[0:], priority)
+	binary.BigEndian.PutUint16(data[2:], weight)
+	binary.BigEndian.PutUint16(data[4:], port)
+	data, err := appendName(data, target)
+	if err != nil {
+		return Resource{}, err
+	}
+	return Resource{Name: name, Type: TypeSRV, Class: ClassINET, TTL: ttl, Data: data}, nil
+}
+
+// Reply returns an empty response to the given query, with its id, opcode,
+// recursion desired flag and questions.
+func (m *Message) Reply(rcode uint8) *Message {
+	return &Message{
+		ID:               m.ID,
+		Response:         true,
+		Opcode:           m.Opcode,
+		RecursionDesired: m.RecursionDesired,
+		Rcode:            rcode,
+		Questions:        m.Questions,
+	}
+}
+
+// Parse parses the header and the questions of the given message.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, errTruncated
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	m := &Message{
+		ID:                 binary.BigEndian.Uint16(b[0:]),
+		Response:           flags&(1<<15) != 0,
+		Opcode:             uint8(flags>>11) & 0xf,
+		Authoritative:      flags&(1<<10) != 0,
+		Truncated:          flags&(1<<9) != 0,
+		RecursionDesired:   flags&(1<<8) != 0,
+		RecursionAvailable: flags&(1<<7) != 0,
+		Rcode:              uint8(flags & 0xf),
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	off := headerLen
+	for i := 0; i < qdcount; i++ {
+		name, n, err := parseName(b, off)
+		if err != nil {
+			return nil, fmt.Errorf("question %d: %v", i, err)
+		}
+		off = n
+		if len(b) < off+4 {
+			return nil, errTruncated
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off:]),
+			Class: binary.BigEndian.Uint16(b[off+2:]),
+		})
+		off += 4
+	}
+	return m, nil
+}
+
+// Pack returns the wire format of the message. Names are not compressed.
+func (m *Message) Pack() ([]byte, error) {
+	b := make([]byte, headerLen, MaxUDPSize)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	flags := uint16(m.Opcode&0xf)<<11 | uint16(m.Rcode&0xf)
+	for _, f := range []struct {
+		set bool
+		bit uint16
+	}{
+		{m.Response, 1 << 15},
+		{m.Authoritative, 1 << 10},
+		{m.Truncated, 1 << 9},
+		{m.RecursionDesired, 1 << 8},
+		{m.RecursionAvailable, 1 << 7},
+	} {
+		if f.set {
+			flags |= f.bit
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, q.Type)
+		b = appendUint16(b, q.Class)
+	}
+	for _, r := range m.Answers {
+		if b, err = appendName(b, r.Name); err != nil {
+			return nil, err
+		}
+		b = appendUint16(b, r.Type)
+		b = appendUint16(b, r.Class)
+		b = append(b, byte(r.TTL>>24), byte(r.TTL>>16), byte(r.TTL>>8), byte(r.TTL))
+		b = appendUint16(b, uint16(len(r.Data)))
+		b = append(b, r.Data...)
+	}
+	return b, nil
+}
+
+// PackUDP is Pack, dropping the answers and setting the truncated flag if
+// the message does not fit in a UDP message.
+func (m *Message) PackUDP() ([]byte, error) {
+	b, err := m.Pack()
+	if err != nil || len(b) <= MaxUDPSize {
+		return b, err
+	}
+	t := *m
+	t.Truncated = true
+	t.Answers = nil
+	return t.Pack()
+}
+
+// ParseSRV returns the priority, weight, port and target of the given SRV
+// record data.
+func ParseSRV(data []byte) (priority, weight, port uint16, target string, err error) {
+	if len(data) < 6 {
+		return 0, 0, 0, "", errTruncated
+	}
+	target, _, err = parseName(data, 6)
+	if err != nil {
+		return 0, 0, 0, "", err
+	}
+	return binary.BigEndian.Uint16(data[0:]), binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]), target, nil
+}
+
+// ParseAnswers parses the answers of the given message, which must have been
+// packed without name compression.
+func ParseAnswers(b []byte) ([]Resource, error) {
+	m, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	off := headerLen
+	for range m.Questions {
+		_, n, err := parseName(b, off)
+		if err != nil {
+			return nil, err
+		}
+		off = n + 4
+	}
+
+	ancount := int(binary.BigEndian.Uint16(b[6:]))
+	var rs []Resource
+	for i := 0; i < ancount; i++ {
+		name, n, err := parseName(b, off)
+		if err != nil {
+			return nil, fmt.Errorf("answer %d: %v", i, err)
+		}
+		off = n
+		if len(b) < off+10 {
+			return nil, errTruncated
+		}
+		r := Resource{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[off:]),
+			Class: binary.BigEndian.Uint16(b[off+2:]),
+			TTL:   binary.BigEndian.Uint32(b[off+4:]),
+		}
+		l := int(binary.BigEndian.Uint16(b[off+8:]))
+		off += 10
+		if len(b) < off+l {
+			return nil, errTruncated
+		}
+		r.Data = b[off : off+l]
+		off += l
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// parseName parses the name at the given offset of the given message and
+// returns it with the offset following it.
+func parseName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for ptrs := 0; ; {
+		if off >= len(b) {
+			return "", 0, errTruncated
+		}
+		l := int(b[off])
+		switch {
+		case l == 0:
+			off++
+			if next < 0 {
+				next = off
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errTruncated
+			}
+			if ptrs++; ptrs > maxPointers {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+		case l&0xc0 != 0:
+			return "", 0, fmt.Errorf("unsupported label type %#x", l&0xc0)
+		default:
+			if off+1+l > len(b) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(b[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// appendName appends the wire format of the given name.
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return nil, fmt.Errorf("name too long: %s", name)
+	}
+	if len(name) > 0 {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, fmt.Errorf("invalid name: %s", name)
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,135 @@
+package dns
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPackParse(t *testing.T) {
+	q := &Message{
+		ID:               0x1234,
+		RecursionDesired: true,
+		Questions:        []Question{{Name: "kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", Type: TypeA, Class: ClassINET}},
+	}
+	b, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, q) {
+		t.Errorf("got wrong message, want=%+v, got=%+v", q, got)
+	}
+
+	srv, err := NewSRV("_etcd-server._tcp.kube-etcd.kube-system.svc.cluster.local.", 10, 100, 2380, "kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local.", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := q.Reply(RcodeSuccess)
+	r.Authoritative = true
+	r.Answers = []Resource{
+		NewA(q.Questions[0].Name, net.ParseIP("10.2.0.5"), 5),
+		NewAAAA(q.Questions[0].Name, net.ParseIP("fd00::5"), 5),
+		srv,
+	}
+	b, err = r.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Response || !m.Authoritative || !m.RecursionDesired || m.ID != q.ID {
+		t.Errorf("got wrong header %+v", m)
+	}
+	answers, err := ParseAnswers(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(answers, r.Answers) {
+		t.Errorf("got wrong answers, want=%+v, got=%+v", r.Answers, answers)
+	}
+
+	priority, weight, port, target, err := ParseSRV(answers[2].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priority != 10 || weight != 100 || port != 2380 || target != "kube-etcd-0000.kube-etcd.kube-system.svc.cluster.local." {
+		t.Errorf("got wrong srv %d %d %d %s", priority, weight, port, target)
+	}
+}
+
+func TestParseCompressedName(t *testing.T) {
+	// example.com. at 12, www.example.com. pointing to it at 25
+	b := make([]byte, headerLen)
+	b = append(b, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	b = append(b, 3, 'w', 'w', 'w', 0xc0, 12)
+
+	name, next, err := parseName(b, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.example.com." || next != len(b) {
+		t.Errorf("got wrong name %s at %d", name, next)
+	}
+
+	// a pointer to itself
+	b = append(make([]byte, headerLen), 0xc0, 12)
+	if _, _, err = parseName(b, 12); err == nil {
+		t.Error("expected failure for a pointer loop")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		make([]byte, 11),
+		// one question without a name
+		{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0},
+		// one question without a type
+		{0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 1, 'a', 0},
+	} {
+		if _, err := Parse(b); err == nil {
+			t.Errorf("expected failure for %v", b)
+		}
+	}
+}
+
+func TestPackUDPTruncates(t *testing.T) {
+	m := &Message{Response: true, Questions: []Question{{Name: "kube-etcd.kube-system.svc.cluster.local.", Type: TypeA, Class: ClassINET}}}
+	for i := 0; i < 40; i++ {
+		m.Answers = append(m.Answers, NewA(m.Questions[0].Name, net.IPv4(10, 2, 0, byte(i)), 5))
+	}
+	b, err := m.PackUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > MaxUDPSize {
+		t.Errorf("expected at most %d bytes, got %d", MaxUDPSize, len(b))
+	}
+	got, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Truncated {
+		t.Error("expected the truncated flag")
+	}
+}
+
+func TestAppendNameErrors(t *testing.T) {
+	for _, name := range []string{"a..b.", strings.Repeat("a", 64) + ".", strings.Repeat("a.", 127) + "a."} {
+		if _, err := appendName(nil, name); err == nil {
+			t.Errorf("expected failure for %q", name)
+		}
+	}
+	b, err := appendName(nil, ".")
+	if err != nil || !bytes.Equal(b, []byte{0}) {
+		t.Errorf("got wrong root name %v: %v", b, err)
+	}
+}
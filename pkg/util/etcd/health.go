@@ -0,0 +1,49 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// healthResponse is the response of the /health endpoint of an etcd member.
+type healthResponse struct {
+	Health string `json:"health"`
+}
+
+// Health returns an error unless the etcd member at the given host:port
+// endpoint reports itself healthy on its /health endpoint.
+func Health(endpoint string, tlsFiles TLSFiles, timeout time.Duration) error {
+	tlsConfig, err := tlsFiles.ClientConfig()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+	defer client.Transport.(*http.Transport).CloseIdleConnections()
+
+	resp, err := client.Get(tlsFiles.Scheme() + "://" + endpoint + "/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unhealthy: %s: %s", resp.Status, b)
+	}
+	var h healthResponse
+	if err = json.Unmarshal(b, &h); err != nil {
+		return fmt.Errorf("failed to decode the health response: %v", err)
+	}
+	if h.Health != "true" {
+		return fmt.Errorf("unhealthy: %s", b)
+	}
+	return nil
+}
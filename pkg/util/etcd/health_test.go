@@ -0,0 +1,52 @@
+package etcd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, addr := startEtcd(t, dir)
+	defer e.Close()
+
+	if err = Health(addr, TLSFiles{}, 5*time.Second); err != nil {
+		t.Errorf("expected a healthy member, got %v", err)
+	}
+}
+
+func TestHealthUnhealthy(t *testing.T) {
+	tests := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusOK, `{"health": "false"}`},
+		{http.StatusServiceUnavailable, `{"health": "false"}`},
+		{http.StatusOK, `<html>`},
+	}
+	for _, tt := range tests {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/health" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		err := Health(strings.TrimPrefix(s.URL, "http://"), TLSFiles{}, time.Second)
+		s.Close()
+		if err == nil {
+			t.Errorf("%d %s: expected failure", tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Package etcd provides the etcd member list of an etcd cluster.
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+// TLSFiles are the TLS files of an etcd client. The members are queried over
+// https if any is given.
+type TLSFiles struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled returns true if any TLS file is given.
+func (f TLSFiles) Enabled() bool {
+	return len(f.CAFile) > 0 || len(f.CertFile) > 0 || len(f.KeyFile) > 0
+}
+
+// Scheme returns the scheme of the etcd client urls: https if TLS is
+// enabled, else http.
+func (f TLSFiles) Scheme() string {
+	if f.Enabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// ClientConfig returns the TLS configuration of the files, or nil if TLS is
+// not enabled.
+func (f TLSFiles) ClientConfig() (*tls.Config, error) {
+	if !f.Enabled() {
+		return nil, nil
+	}
+	tlsInfo := transport.TLSInfo{
+		CertFile:      f.CertFile,
+		KeyFile:       f.KeyFile,
+		TrustedCAFile: f.CAFile,
+	}
+	cfg, err := tlsInfo.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the etcd TLS files: %v", err)
+	}
+	return cfg, nil
+}
+
+// MemberEndpoints returns the sorted ip:port client endpoints of the members
+// of the etcd cluster, read from the member list of the given host:port
+// endpoints. It fails if the client url of a started member cannot be parsed
+// or resolved, as the endpoints would miss the member.
+func MemberEndpoints(endpoints []string, tlsFiles TLSFiles, timeout time.Duration) ([]string, error) {
+	tlsConfig, err := tlsFiles.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := clientv3.Config{DialTimeout: timeout, TLS: tlsConfig}
+	for _, ep := range endpoints {
+		cfg.Endpoints = append(cfg.Endpoints, tlsFiles.Scheme()+"://"+ep)
+	}
+
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd at %v: %v", endpoints, err)
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	resp, err := cli.MemberList(ctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the etcd members: %v", err)
+	}
+
+	return membersEndpoints(resp.Members)
+}
+
+// membersEndpoints returns the sorted ip:port client endpoints of the given
+// members.
+func membersEndpoints(members []*pb.Member) ([]string, error) {
+	seen := map[string]bool{}
+	var eps []string
+	for _, m := range members {
+		// members that have not started yet have no client urls
+		for _, u := range m.ClientURLs {
+			addrs, err := ClientURLEndpoints(u)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve the client url %s of etcd member %s: %v", u, m.Name, err)
+			}
+			for _, addr := range addrs {
+				if !seen[addr] {
+					seen[addr] = true
+					eps = append(eps, addr)
+				}
+			}
+		}
+	}
+	sort.Strings(eps)
+	return eps, nil
+}
+
+// ClientURLEndpoints returns the ip:port endpoints of the given member client
+// url. A host name is resolved.
+func ClientURLEndpoints(clientURL string) ([]string, error) {
+	u, err := url.Parse(clientURL)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{net.JoinHostPort(host, port)}, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+	var eps []string
+	for _, ip := range ips {
+		eps = append(eps, net.JoinHostPort(ip, port))
+	}
+	return eps, nil
+}
@@ -0,0 +1,121 @@
+package etcd
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+)
+
+// freeLocalAddr returns a free local TCP address.
+func freeLocalAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEtcd starts a single member etcd server in the given directory and
+// returns its client address.
+func startEtcd(t *testing.T, dir string) (*embed.Etcd, string) {
+	clientAddr := freeLocalAddr(t)
+	peerAddr := freeLocalAddr(t)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	curl := url.URL{Scheme: "http", Host: clientAddr}
+	purl := url.URL{Scheme: "http", Host: peerAddr}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{curl}, []url.URL{curl}
+	cfg.LPUrls, cfg.APUrls = []url.URL{purl}, []url.URL{purl}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		t.Fatal("etcd did not start")
+	}
+	return e, clientAddr
+}
+
+func TestMemberEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, addr := startEtcd(t, dir)
+	defer e.Close()
+
+	got, err := MemberEndpoints([]string{addr}, TLSFiles{}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{addr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong endpoints, want=%v, got=%v", want, got)
+	}
+
+	if _, err = MemberEndpoints([]string{freeLocalAddr(t)}, TLSFiles{}, 500*time.Millisecond); err == nil {
+		t.Error("expected failure without members")
+	}
+	if _, err = MemberEndpoints([]string{addr}, TLSFiles{CAFile: dir + "/missing-ca.crt"}, time.Second); err == nil {
+		t.Error("expected failure for missing TLS files")
+	}
+}
+
+func TestMembersEndpoints(t *testing.T) {
+	members := []*pb.Member{
+		{Name: "etcd-0", ClientURLs: []string{"https://10.2.0.5:2379"}},
+		// not started yet
+		{Name: ""},
+		{Name: "etcd-1", ClientURLs: []string{"https://10.2.0.4:2379", "https://10.2.0.4:2379"}},
+	}
+	got, err := membersEndpoints(members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.2.0.4:2379", "10.2.0.5:2379"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got wrong endpoints, want=%v, got=%v", want, got)
+	}
+
+	// a partial list would drop the member from the checkpoint
+	members = append(members, &pb.Member{Name: "etcd-2", ClientURLs: []string{"https://etcd-2.kenc.invalid:2379"}})
+	if got, err = membersEndpoints(members); err == nil {
+		t.Errorf("expected failure for an unresolved member, got %v", got)
+	}
+}
+
+func TestClientURLEndpoints(t *testing.T) {
+	tests := []struct {
+		url  string
+		want []string
+		ok   bool
+	}{
+		{"https://10.2.0.5:2379", []string{"10.2.0.5:2379"}, true},
+		{"http://[fd00::5]:12379", []string{"[fd00::5]:12379"}, true},
+		{"https://10.2.0.5", nil, false},
+		{"://", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ClientURLEndpoints(tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got wrong error %v", tt.url, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got wrong endpoints, want=%v, got=%v", tt.url, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package ipset provides an interface and implementations for running ipset commands.
+package ipset
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// An injectable interface for running ipset commands.  Implementations must be goroutine-safe.
+type Interface interface {
+	// Restore runs `ipset restore` passing data through []byte.
+	// data should be formatted like the output of Save()
+	Restore(data []byte) error
+	// Save calls `ipset save` for the given set.
+	Save(set string) ([]byte, error)
+}
+
+const (
+	cmdIPSet string = "ipset"
+)
+
+// runner implements Interface in terms of exec("ipset").
+type runner struct {
+	mu   sync.Mutex
+	exec utilexec.Interface
+}
+
+// New returns a new Interface which will exec ipset.
+func New(exec utilexec.Interface) Interface {
+	return &runner{
+		exec: exec,
+	}
+}
+
+// Restore is part of Interface.
+func (runner *runner) Restore(data []byte) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"restore"}
+
+	// run the command and return the output or an error including the output and error
+	logrus.Infof("running ipset %v", args)
+	cmd := runner.exec.Command(cmdIPSet, args...)
+	cmd.SetStdin(bytes.NewBuffer(data))
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v (%s)", err, b)
+	}
+	return nil
+}
+
+// Save is part of Interface.
+func (runner *runner) Save(set string) ([]byte, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	// run and return
+	args := []string{"save", set}
+	logrus.Infof("running ipset %v", args)
+	return runner.exec.Command(cmdIPSet, args...).CombinedOutput()
+}
@@ -0,0 +1,73 @@
+package ipset
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/coreos/kenc/pkg/util/exec"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestRestore(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte("ipset v6.32: Error in line 1"), &exec.FakeExitError{Status: 1} },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	data := "create FOO hash:ip,port family inet -exist\n"
+	err := runner.Restore([]byte(data))
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ipset", "restore") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+	b, err := ioutil.ReadAll(fcmd.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != data {
+		t.Errorf("expected stdin %q, got %q", data, b)
+	}
+
+	// Failure.
+	err = runner.Restore([]byte(data))
+	if err == nil {
+		t.Errorf("expected failure")
+	}
+}
+
+func TestSave(t *testing.T) {
+	output := "create FOO hash:ip,port family inet hashsize 1024 maxelem 65536\nadd FOO 10.2.0.4,tcp:2379\n"
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(output), nil },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	o, err := runner.Save("FOO")
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if string(o) != output {
+		t.Errorf("expected output to be equal to mocked one, got %s", o)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ipset", "save", "FOO") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+}
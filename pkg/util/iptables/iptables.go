@@ -27,8 +27,8 @@ import (
 	utilexec "github.com/coreos/kenc/pkg/util/exec"
 	utilversion "github.com/coreos/kenc/pkg/util/version"
 
-	"github.com/Sirupsen/logrus"
 	godbus "github.com/godbus/dbus"
+	"github.com/sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/util/sets"
 )
 
@@ -67,6 +67,9 @@ type Interface interface {
 	Restore(table Table, data []byte, flush FlushFlag, counters RestoreCountersFlag) error
 	// RestoreAll is the same as Restore except that no table is specified.
 	RestoreAll(data []byte, flush FlushFlag, counters RestoreCountersFlag) error
+	// ValidateRestoreAll runs `iptables-restore --test` passing data through []byte.
+	// It checks that data can be restored without committing it.
+	ValidateRestoreAll(data []byte, flush FlushFlag) error
 	// AddReloadFunc adds a function to call on iptables reload
 	AddReloadFunc(reloadFunc func())
 	// Destroy cleans up resources used by the Interface
@@ -94,15 +97,36 @@ const (
 	ChainPrerouting  Chain = "PREROUTING"
 	ChainOutput      Chain = "OUTPUT"
 	ChainInput       Chain = "INPUT"
+	ChainForward     Chain = "FORWARD"
 )
 
 const (
-	cmdIPTablesSave    string = "iptables-save"
-	cmdIPTablesRestore string = "iptables-restore"
-	cmdIPTables        string = "iptables"
-	cmdIp6tables       string = "ip6tables"
+	cmdIPTablesSave     string = "iptables-save"
+	cmdIPTablesRestore  string = "iptables-restore"
+	cmdIP6TablesSave    string = "ip6tables-save"
+	cmdIP6TablesRestore string = "ip6tables-restore"
+	cmdIPTables         string = "iptables"
+	cmdIp6tables        string = "ip6tables"
 )
 
+// Mode selects the iptables variant the runner execs.
+type Mode string
+
+const (
+	// ModeDefault uses the plain iptables commands.
+	ModeDefault Mode = "default"
+	// ModeAuto probes the legacy and nft variants and uses the one that
+	// holds the kube-proxy rules.
+	ModeAuto Mode = "auto"
+	// ModeLegacy uses the iptables-legacy commands.
+	ModeLegacy Mode = "legacy"
+	// ModeNFT uses the iptables-nft commands.
+	ModeNFT Mode = "nft"
+)
+
+// The chain probed for in ModeAuto. It is created by kube-proxy in the nat table.
+const probeChain Chain = "KUBE-SERVICES"
+
 // Option flag for Restore
 type RestoreCountersFlag bool
 
@@ -129,6 +153,9 @@ type runner struct {
 	exec     utilexec.Interface
 	dbus     utildbus.Interface
 	protocol Protocol
+	mode     Mode
+	// detect is true in ModeAuto while the variant is not detected yet
+	detect   bool
 	hasCheck bool
 	waitFlag []string
 
@@ -138,22 +165,92 @@ type runner struct {
 
 // New returns a new Interface which will exec iptables.
 func New(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol) Interface {
-	vstring, err := getIPTablesVersionString(exec)
-	if err != nil {
-		logrus.Warningf("Error checking iptables version, assuming version at least %s: %v", MinCheckVersion, err)
-		vstring = MinCheckVersion
+	return NewWithMode(exec, dbus, protocol, ModeDefault)
+}
+
+// NewWithMode returns a new Interface which will exec the iptables variant
+// selected by mode. In ModeAuto, the variant is detected at construction. If
+// it cannot be detected yet, e.g. before kube-proxy first synced, the plain
+// iptables commands are used and the detection is retried on every Save and
+// SaveAll until it succeeds. An empty mode is ModeDefault.
+func NewWithMode(exec utilexec.Interface, dbus utildbus.Interface, protocol Protocol, mode Mode) Interface {
+	if mode == "" {
+		mode = ModeDefault
 	}
 	runner := &runner{
 		exec:     exec,
 		dbus:     dbus,
 		protocol: protocol,
-		hasCheck: getIPTablesHasCheckCommand(vstring),
-		waitFlag: getIPTablesWaitFlag(vstring),
+		mode:     mode,
+	}
+	if mode == ModeAuto {
+		var ok bool
+		runner.mode, ok = runner.detectMode()
+		runner.detect = !ok
+		if runner.detect {
+			logrus.Warningf("Could not detect iptables mode (chain %s not found in a single variant), using default until it is", probeChain)
+		} else {
+			logrus.Infof("using %s", runner.iptablesCommand())
+		}
 	}
+
+	runner.checkVersion()
 	runner.connectToFirewallD()
 	return runner
 }
 
+// checkVersion sets the flags supported by the version of the iptables
+// command of the runner.
+func (runner *runner) checkVersion() {
+	vstring, err := getIPTablesVersionString(runner.exec, runner.iptablesCommand())
+	if err != nil {
+		logrus.Warningf("Error checking iptables version, assuming version at least %s: %v", MinCheckVersion, err)
+		vstring = MinCheckVersion
+	}
+	runner.hasCheck = getIPTablesHasCheckCommand(vstring)
+	runner.waitFlag = getIPTablesWaitFlag(vstring)
+}
+
+// redetectMode retries the detection of the variant in ModeAuto until it
+// succeeds. runner.mu must be held.
+func (runner *runner) redetectMode() {
+	if !runner.detect {
+		return
+	}
+	mode, ok := runner.detectMode()
+	if !ok {
+		return
+	}
+	runner.mode, runner.detect = mode, false
+	logrus.Infof("detected iptables mode, using %s", runner.iptablesCommand())
+	runner.checkVersion()
+}
+
+// detectMode returns the variant whose nat table holds the kube-proxy
+// services chain. It returns false and ModeDefault, the plain iptables
+// commands, if neither or both of them do.
+func (runner *runner) detectMode() (Mode, bool) {
+	var found []Mode
+	for _, mode := range []Mode{ModeLegacy, ModeNFT} {
+		saveCmd := commandForMode(runner.saveBaseCommand(), mode)
+		logrus.Infof("running %s -t %s", saveCmd, string(TableNAT))
+		out, err := runner.exec.Command(saveCmd, "-t", string(TableNAT)).CombinedOutput()
+		if err != nil {
+			logrus.Infof("%s is not usable: %v", saveCmd, err)
+			continue
+		}
+		if _, ok := GetChainLines(TableNAT, out)[probeChain]; ok {
+			found = append(found, mode)
+		}
+	}
+
+	if len(found) != 1 {
+		logrus.Infof("chain %s found in iptables modes %v", probeChain, found)
+		return ModeDefault, false
+	}
+	return found[0], true
+}
+
 // Destroy is part of Interface.
 func (runner *runner) Destroy() {
 	if runner.signal != nil {
@@ -191,7 +288,7 @@ func (runner *runner) connectToFirewallD() {
 
 // GetVersion returns the version string.
 func (runner *runner) GetVersion() (string, error) {
-	return getIPTablesVersionString(runner.exec)
+	return getIPTablesVersionString(runner.exec, runner.iptablesCommand())
 }
 
 // EnsureChain is part of Interface.
@@ -292,21 +389,25 @@ func (runner *runner) IsIpv6() bool {
 func (runner *runner) Save(table Table) ([]byte, error) {
 	runner.mu.Lock()
 	defer runner.mu.Unlock()
+	runner.redetectMode()
 
 	// run and return
+	iptablesSaveCmd := runner.iptablesSaveCommand()
 	args := []string{"-t", string(table)}
-	logrus.Infof("running iptables-save %v", args)
-	return runner.exec.Command(cmdIPTablesSave, args...).CombinedOutput()
+	logrus.Infof("running %s %v", iptablesSaveCmd, args)
+	return runner.exec.Command(iptablesSaveCmd, args...).CombinedOutput()
 }
 
 // SaveAll is part of Interface.
 func (runner *runner) SaveAll() ([]byte, error) {
 	runner.mu.Lock()
 	defer runner.mu.Unlock()
+	runner.redetectMode()
 
 	// run and return
-	logrus.Infof("running iptables-save")
-	return runner.exec.Command(cmdIPTablesSave, []string{}...).CombinedOutput()
+	iptablesSaveCmd := runner.iptablesSaveCommand()
+	logrus.Infof("running %s", iptablesSaveCmd)
+	return runner.exec.Command(iptablesSaveCmd, []string{}...).CombinedOutput()
 }
 
 // Restore is part of Interface.
@@ -323,7 +424,14 @@ func (runner *runner) RestoreAll(data []byte, flush FlushFlag, counters RestoreC
 	return runner.restoreInternal(args, data, flush, counters)
 }
 
-// restoreInternal is the shared part of Restore/RestoreAll
+// ValidateRestoreAll is part of Interface.
+func (runner *runner) ValidateRestoreAll(data []byte, flush FlushFlag) error {
+	// setup args
+	args := []string{"--test"}
+	return runner.restoreInternal(args, data, flush, NoRestoreCounters)
+}
+
+// restoreInternal is the shared part of Restore/RestoreAll/ValidateRestoreAll
 func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFlag, counters RestoreCountersFlag) error {
 	runner.mu.Lock()
 	defer runner.mu.Unlock()
@@ -336,8 +444,9 @@ func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFla
 	}
 
 	// run the command and return the output or an error including the output and error
-	logrus.Infof("running iptables-restore %v", args)
-	cmd := runner.exec.Command(cmdIPTablesRestore, args...)
+	iptablesRestoreCmd := runner.iptablesRestoreCommand()
+	logrus.Infof("running %s %v", iptablesRestoreCmd, args)
+	cmd := runner.exec.Command(iptablesRestoreCmd, args...)
 	cmd.SetStdin(bytes.NewBuffer(data))
 	b, err := cmd.CombinedOutput()
 	if err != nil {
@@ -348,10 +457,42 @@ func (runner *runner) restoreInternal(args []string, data []byte, flush FlushFla
 
 func (runner *runner) iptablesCommand() string {
 	if runner.IsIpv6() {
-		return cmdIp6tables
+		return commandForMode(cmdIp6tables, runner.mode)
 	} else {
-		return cmdIPTables
+		return commandForMode(cmdIPTables, runner.mode)
+	}
+}
+
+func (runner *runner) saveBaseCommand() string {
+	if runner.IsIpv6() {
+		return cmdIP6TablesSave
+	} else {
+		return cmdIPTablesSave
+	}
+}
+
+func (runner *runner) iptablesSaveCommand() string {
+	return commandForMode(runner.saveBaseCommand(), runner.mode)
+}
+
+func (runner *runner) iptablesRestoreCommand() string {
+	if runner.IsIpv6() {
+		return commandForMode(cmdIP6TablesRestore, runner.mode)
+	} else {
+		return commandForMode(cmdIPTablesRestore, runner.mode)
+	}
+}
+
+// commandForMode returns the variant of the given iptables command for mode,
+// e.g. "iptables-save" becomes "iptables-legacy-save" in ModeLegacy.
+func commandForMode(cmd string, mode Mode) string {
+	if mode != ModeLegacy && mode != ModeNFT {
+		return cmd
+	}
+	if i := strings.Index(cmd, "-"); i >= 0 {
+		return cmd[:i] + "-" + string(mode) + cmd[i:]
 	}
+	return cmd + "-" + string(mode)
 }
 
 func (runner *runner) run(op operation, args []string) ([]byte, error) {
@@ -384,8 +525,9 @@ func trimhex(s string) string {
 // Present for compatibility with <1.4.11 versions of iptables.  This is full
 // of hack and half-measures.  We should nix this ASAP.
 func (runner *runner) checkRuleWithoutCheck(table Table, chain Chain, args ...string) (bool, error) {
-	logrus.Infof("running iptables-save -t %s", string(table))
-	out, err := runner.exec.Command(cmdIPTablesSave, "-t", string(table)).CombinedOutput()
+	iptablesSaveCmd := runner.iptablesSaveCommand()
+	logrus.Infof("running %s -t %s", iptablesSaveCmd, string(table))
+	out, err := runner.exec.Command(iptablesSaveCmd, "-t", string(table)).CombinedOutput()
 	if err != nil {
 		return false, fmt.Errorf("error checking rule: %v", err)
 	}
@@ -506,9 +648,9 @@ func getIPTablesWaitFlag(vstring string) []string {
 
 // getIPTablesVersionString runs "iptables --version" to get the version string
 // in the form "X.X.X"
-func getIPTablesVersionString(exec utilexec.Interface) (string, error) {
+func getIPTablesVersionString(exec utilexec.Interface, iptablesCmd string) (string, error) {
 	// this doesn't access mutable state so we don't need to use the interface / runner
-	bytes, err := exec.Command(cmdIPTables, "--version").CombinedOutput()
+	bytes, err := exec.Command(iptablesCmd, "--version").CombinedOutput()
 	if err != nil {
 		return "", err
 	}
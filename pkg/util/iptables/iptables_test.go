@@ -451,7 +451,7 @@ func TestGetIPTablesHasCheckCommand(t *testing.T) {
 				func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
 			},
 		}
-		version, err := getIPTablesVersionString(&fexec)
+		version, err := getIPTablesVersionString(&fexec, cmdIPTables)
 		if (err != nil) != testCase.Err {
 			t.Errorf("Expected error: %v, Got error: %v", testCase.Err, err)
 		}
@@ -992,3 +992,221 @@ func TestRestoreAll(t *testing.T) {
 		t.Errorf("expected failure")
 	}
 }
+
+// TestValidateRestoreAll tests that a payload is checked with iptables-restore --test
+func TestValidateRestoreAll(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// iptables version check
+			func() ([]byte, error) { return []byte("iptables v1.9.22"), nil },
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) {
+				return []byte("iptables-restore: line 3 failed"), &exec.FakeExitError{Status: 1}
+			},
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec, dbus.NewFake(nil, nil), ProtocolIpv4)
+	defer runner.Destroy()
+
+	if err := runner.ValidateRestoreAll([]byte{}, NoFlushTables); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("iptables-restore", "--test", "--noflush") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+	if sets.NewString(fcmd.CombinedOutputLog[1]...).Has("--counters") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+
+	if err := runner.ValidateRestoreAll([]byte{}, NoFlushTables); err == nil {
+		t.Errorf("expected failure")
+	}
+}
+
+// TestSaveRestoreIpv6 tests that an ipv6 runner uses the ip6tables variants of save/restore
+func TestSaveRestoreIpv6(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// iptables version check
+			func() ([]byte, error) { return []byte("iptables v1.9.22"), nil },
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte{}, nil },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec, dbus.NewFake(nil, nil), ProtocolIpv6)
+	defer runner.Destroy()
+
+	if _, err := runner.Save(TableNAT); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("ip6tables-save", "-t", "nat") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+
+	if _, err := runner.SaveAll(); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[2]...).HasAll("ip6tables-save") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[2])
+	}
+
+	if err := runner.RestoreAll([]byte{}, NoFlushTables, NoRestoreCounters); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[3]...).HasAll("ip6tables-restore", "--noflush") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[3])
+	}
+}
+
+func TestCommandForMode(t *testing.T) {
+	testCases := []struct {
+		cmd  string
+		mode Mode
+		want string
+	}{
+		{"iptables", ModeDefault, "iptables"},
+		{"iptables", "", "iptables"},
+		{"iptables", ModeLegacy, "iptables-legacy"},
+		{"iptables-save", ModeLegacy, "iptables-legacy-save"},
+		{"ip6tables-restore", ModeNFT, "ip6tables-nft-restore"},
+		{"iptables-save", ModeAuto, "iptables-save"},
+	}
+
+	for _, tc := range testCases {
+		got := commandForMode(tc.cmd, tc.mode)
+		if got != tc.want {
+			t.Errorf("For %s in mode %q expected %s got %s", tc.cmd, tc.mode, tc.want, got)
+		}
+	}
+}
+
+func TestNewWithModeAuto(t *testing.T) {
+	kubeOutput := `*nat
+:PREROUTING ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+COMMIT`
+	emptyOutput := `*nat
+:PREROUTING ACCEPT [0:0]
+COMMIT`
+
+	testCases := []struct {
+		legacy   func() ([]byte, error)
+		nft      func() ([]byte, error)
+		wantSave string
+	}{
+		{
+			legacy:   func() ([]byte, error) { return []byte(emptyOutput), nil },
+			nft:      func() ([]byte, error) { return []byte(kubeOutput), nil },
+			wantSave: "iptables-nft-save",
+		},
+		{
+			legacy:   func() ([]byte, error) { return []byte(kubeOutput), nil },
+			nft:      func() ([]byte, error) { return nil, exec.ErrExecutableNotFound },
+			wantSave: "iptables-legacy-save",
+		},
+	}
+
+	for i, tc := range testCases {
+		fcmd := exec.FakeCmd{
+			CombinedOutputScript: []exec.FakeCombinedOutputAction{
+				tc.legacy,
+				tc.nft,
+				// iptables version check
+				func() ([]byte, error) { return []byte("iptables v1.9.22"), nil },
+				func() ([]byte, error) { return []byte{}, nil },
+			},
+		}
+		fexec := exec.FakeExec{
+			CommandScript: []exec.FakeCommandAction{
+				func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+				func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+				func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+				func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			},
+		}
+		runner := NewWithMode(&fexec, dbus.NewFake(nil, nil), ProtocolIpv4, ModeAuto)
+
+		if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("iptables-legacy-save", "-t", "nat") {
+			t.Errorf("%d: wrong CombinedOutput() log, got %s", i, fcmd.CombinedOutputLog[0])
+		}
+		if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("iptables-nft-save", "-t", "nat") {
+			t.Errorf("%d: wrong CombinedOutput() log, got %s", i, fcmd.CombinedOutputLog[1])
+		}
+
+		if _, err := runner.SaveAll(); err != nil {
+			t.Errorf("%d: expected success, got %v", i, err)
+		}
+		if fcmd.CombinedOutputLog[3][0] != tc.wantSave {
+			t.Errorf("%d: expected %s, got %s", i, tc.wantSave, fcmd.CombinedOutputLog[3])
+		}
+		runner.Destroy()
+	}
+}
+
+func TestNewWithModeAutoRedetects(t *testing.T) {
+	kubeOutput := `*nat
+:PREROUTING ACCEPT [0:0]
+:KUBE-SERVICES - [0:0]
+COMMIT`
+	emptyOutput := `*nat
+:PREROUTING ACCEPT [0:0]
+COMMIT`
+	empty := func() ([]byte, error) { return []byte(emptyOutput), nil }
+	kube := func() ([]byte, error) { return []byte(kubeOutput), nil }
+	version := func() ([]byte, error) { return []byte("iptables v1.9.22"), nil }
+	save := func() ([]byte, error) { return []byte{}, nil }
+
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// kube-proxy has not synced yet
+			empty, empty, version,
+			empty, empty, save,
+			// kube-proxy synced with iptables-nft
+			empty, kube, version, save,
+			save,
+		},
+	}
+	fexec := exec.FakeExec{}
+	for range fcmd.CombinedOutputScript {
+		fexec.CommandScript = append(fexec.CommandScript, func(cmd string, args ...string) exec.Cmd {
+			return exec.InitFakeCmd(&fcmd, cmd, args...)
+		})
+	}
+	runner := NewWithMode(&fexec, dbus.NewFake(nil, nil), ProtocolIpv4, ModeAuto)
+	defer runner.Destroy()
+
+	for _, want := range []struct {
+		save int
+		cmd  string
+	}{
+		{5, "iptables-save"},
+		{9, "iptables-nft-save"},
+		{10, "iptables-nft-save"},
+	} {
+		if _, err := runner.SaveAll(); err != nil {
+			t.Fatalf("expected success, got %v", err)
+		}
+		if fcmd.CombinedOutputLog[want.save][0] != want.cmd {
+			t.Errorf("expected %s, got %s", want.cmd, fcmd.CombinedOutputLog[want.save])
+		}
+	}
+	if fcmd.CombinedOutputCalls != len(fcmd.CombinedOutputScript) {
+		t.Errorf("expected %d commands, got %d", len(fcmd.CombinedOutputScript), fcmd.CombinedOutputCalls)
+	}
+}
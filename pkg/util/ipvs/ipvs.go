@@ -0,0 +1,149 @@
+// Package ipvs provides an interface and implementations for running ipvsadm
+// commands and managing the dummy device IPVS virtual addresses are bound to.
+package ipvs
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// An injectable interface for running ipvsadm commands.  Implementations must be goroutine-safe.
+type Interface interface {
+	// SaveAll calls `ipvsadm --save -n`.
+	SaveAll() ([]byte, error)
+	// RestoreAll runs `ipvsadm --restore` passing data through []byte.
+	// data should be formatted like the output of SaveAll()
+	RestoreAll(data []byte) error
+	// DeleteVirtualServer deletes the TCP virtual server with the given
+	// "host:port" address.  If the virtual server did not exist, return nil.
+	DeleteVirtualServer(address string) error
+	// EnsureDummyDevice checks if the specified dummy device exists and, if not, creates it.  If the device existed, return true.
+	EnsureDummyDevice(dev string) (bool, error)
+	// EnsureAddressBind checks if the address is bound to the device and, if not, binds it.  If the address was bound, return true.
+	EnsureAddressBind(address, dev string) (bool, error)
+}
+
+const (
+	cmdIPVSAdm string = "ipvsadm"
+	cmdIP      string = "ip"
+)
+
+// runner implements Interface in terms of exec("ipvsadm") and exec("ip").
+type runner struct {
+	mu   sync.Mutex
+	exec utilexec.Interface
+}
+
+// New returns a new Interface which will exec ipvsadm and ip.
+func New(exec utilexec.Interface) Interface {
+	return &runner{
+		exec: exec,
+	}
+}
+
+// SaveAll is part of Interface.
+func (runner *runner) SaveAll() ([]byte, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	// run and return
+	args := []string{"--save", "-n"}
+	logrus.Infof("running ipvsadm %v", args)
+	return runner.exec.Command(cmdIPVSAdm, args...).CombinedOutput()
+}
+
+// RestoreAll is part of Interface.
+func (runner *runner) RestoreAll(data []byte) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	// run the command and return the output or an error including the output and error
+	logrus.Infof("running ipvsadm --restore")
+	cmd := runner.exec.Command(cmdIPVSAdm, "--restore")
+	cmd.SetStdin(bytes.NewBuffer(data))
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v (%s)", err, b)
+	}
+	return nil
+}
+
+// DeleteVirtualServer is part of Interface.
+func (runner *runner) DeleteVirtualServer(address string) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"--delete-service", "--tcp-service", address}
+	logrus.Infof("running ipvsadm %v", args)
+	out, err := runner.exec.Command(cmdIPVSAdm, args...).CombinedOutput()
+	if err != nil {
+		if isNotFound(out) {
+			return nil
+		}
+		return fmt.Errorf("error deleting virtual server %q: %v: %s", address, err, out)
+	}
+	return nil
+}
+
+// EnsureDummyDevice is part of Interface.
+func (runner *runner) EnsureDummyDevice(dev string) (bool, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"link", "add", dev, "type", "dummy"}
+	logrus.Infof("running ip %v", args)
+	out, err := runner.exec.Command(cmdIP, args...).CombinedOutput()
+	if err != nil {
+		if isExists(out) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error creating dummy device %q: %v: %s", dev, err, out)
+	}
+	return false, nil
+}
+
+// EnsureAddressBind is part of Interface.
+func (runner *runner) EnsureAddressBind(address, dev string) (bool, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false, fmt.Errorf("invalid address %q", address)
+	}
+	prefix := address + "/32"
+	if ip.To4() == nil {
+		prefix = address + "/128"
+	}
+
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"addr", "add", prefix, "dev", dev}
+	logrus.Infof("running ip %v", args)
+	out, err := runner.exec.Command(cmdIP, args...).CombinedOutput()
+	if err != nil {
+		if isExists(out) {
+			return true, nil
+		}
+		return false, fmt.Errorf("error binding address %q to %q: %v: %s", address, dev, err, out)
+	}
+	return false, nil
+}
+
+// isExists returns true if the command output indicates the object to create
+// exists already.  It parses the output looking for known values, which is
+// imperfect but works in practice.
+func isExists(out []byte) bool {
+	return strings.Contains(string(out), "File exists")
+}
+
+// isNotFound returns true if the command output indicates the object to
+// delete does not exist.
+func isNotFound(out []byte) bool {
+	return strings.Contains(string(out), "No such service")
+}
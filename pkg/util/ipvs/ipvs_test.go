@@ -0,0 +1,142 @@
+package ipvs
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/coreos/kenc/pkg/util/exec"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestSaveRestoreAll(t *testing.T) {
+	output := `-A -t 10.3.0.15:2379 -s rr
+-a -t 10.3.0.15:2379 -r 10.2.0.4:2379 -m -w 1
+`
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(output), nil },
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte("Memory allocation problem"), &exec.FakeExitError{Status: 1} },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	o, err := runner.SaveAll()
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if string(o) != output {
+		t.Errorf("expected output to be equal to mocked one, got %s", o)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ipvsadm", "--save", "-n") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+
+	err = runner.RestoreAll(o)
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("ipvsadm", "--restore") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+	b, err := ioutil.ReadAll(fcmd.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != output {
+		t.Errorf("expected stdin %q, got %q", output, b)
+	}
+
+	// Failure.
+	err = runner.RestoreAll(o)
+	if err == nil {
+		t.Errorf("expected failure")
+	}
+}
+
+func TestDeleteVirtualServer(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// Success.
+			func() ([]byte, error) { return []byte{}, nil },
+			// Does not exist.
+			func() ([]byte, error) { return []byte("No such service"), &exec.FakeExitError{Status: 2} },
+			// Failure.
+			func() ([]byte, error) { return []byte("Permission denied"), &exec.FakeExitError{Status: 2} },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	if err := runner.DeleteVirtualServer("10.3.0.15:2379"); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ipvsadm", "--delete-service", "--tcp-service", "10.3.0.15:2379") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+	if err := runner.DeleteVirtualServer("10.3.0.15:2379"); err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if err := runner.DeleteVirtualServer("10.3.0.15:2379"); err == nil {
+		t.Errorf("expected failure")
+	}
+}
+
+func TestEnsureAddressBind(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			// Success.
+			func() ([]byte, error) { return []byte{}, nil },
+			// Exists.
+			func() ([]byte, error) {
+				return []byte("RTNETLINK answers: File exists"), &exec.FakeExitError{Status: 2}
+			},
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	exists, err := runner.EnsureAddressBind("10.3.0.15", "kube-ipvs0")
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if exists {
+		t.Errorf("expected exists = false")
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("ip", "addr", "add", "10.3.0.15/32", "dev", "kube-ipvs0") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+
+	exists, err = runner.EnsureAddressBind("fd00:10:3::15", "kube-ipvs0")
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+	if !exists {
+		t.Errorf("expected exists = true")
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[1]...).HasAll("fd00:10:3::15/128") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[1])
+	}
+
+	if _, err = runner.EnsureAddressBind("not-an-ip", "kube-ipvs0"); err == nil {
+		t.Errorf("expected failure")
+	}
+}
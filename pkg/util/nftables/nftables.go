@@ -0,0 +1,79 @@
+// Package nftables provides an interface and implementations for running nft commands.
+package nftables
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	utilexec "github.com/coreos/kenc/pkg/util/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// An injectable interface for running nft commands.  Implementations must be goroutine-safe.
+type Interface interface {
+	// Apply runs `nft -f -` passing data through []byte.
+	// data should be formatted like the output of ListTable(). All commands
+	// in data are applied in a single transaction.
+	Apply(data []byte) error
+	// ListTable calls `nft list table` for the given table.
+	ListTable(family Family, table string) ([]byte, error)
+}
+
+// Family is a nftables address family.
+type Family string
+
+const (
+	FamilyIPv4 Family = "ip"
+	FamilyIPv6 Family = "ip6"
+)
+
+const (
+	cmdNft string = "nft"
+)
+
+// runner implements Interface in terms of exec("nft").
+type runner struct {
+	mu   sync.Mutex
+	exec utilexec.Interface
+}
+
+// New returns a new Interface which will exec nft.
+func New(exec utilexec.Interface) Interface {
+	return &runner{
+		exec: exec,
+	}
+}
+
+// Apply is part of Interface.
+func (runner *runner) Apply(data []byte) error {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"-f", "-"}
+
+	// run the command and return the output or an error including the output and error
+	logrus.Infof("running nft %v", args)
+	cmd := runner.exec.Command(cmdNft, args...)
+	cmd.SetStdin(bytes.NewBuffer(data))
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v (%s)", err, b)
+	}
+	return nil
+}
+
+// ListTable is part of Interface.
+func (runner *runner) ListTable(family Family, table string) ([]byte, error) {
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+
+	args := []string{"list", "table", string(family), table}
+	logrus.Infof("running nft %v", args)
+	b, err := runner.exec.Command(cmdNft, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v (%s)", err, b)
+	}
+	return b, nil
+}
@@ -0,0 +1,84 @@
+package nftables
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/coreos/kenc/pkg/util/exec"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestApply(t *testing.T) {
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte{}, nil },
+			func() ([]byte, error) { return []byte("Error: syntax error"), &exec.FakeExitError{Status: 1} },
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	data := "table ip kenc {}\n"
+	err := runner.Apply([]byte(data))
+	if err != nil {
+		t.Errorf("expected success, got %v", err)
+	}
+
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("nft", "-f", "-") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+	b, err := ioutil.ReadAll(fcmd.Stdin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != data {
+		t.Errorf("expected stdin %q, got %q", data, b)
+	}
+
+	// Failure.
+	err = runner.Apply([]byte(data))
+	if err == nil {
+		t.Errorf("expected failure")
+	}
+}
+
+func TestListTable(t *testing.T) {
+	output := "table ip kenc {\n}\n"
+	fcmd := exec.FakeCmd{
+		CombinedOutputScript: []exec.FakeCombinedOutputAction{
+			func() ([]byte, error) { return []byte(output), nil },
+			func() ([]byte, error) {
+				return []byte("Error: No such file or directory"), &exec.FakeExitError{Status: 1}
+			},
+		},
+	}
+	fexec := exec.FakeExec{
+		CommandScript: []exec.FakeCommandAction{
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+			func(cmd string, args ...string) exec.Cmd { return exec.InitFakeCmd(&fcmd, cmd, args...) },
+		},
+	}
+	runner := New(&fexec)
+
+	o, err := runner.ListTable(FamilyIPv6, "kenc")
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if string(o) != output {
+		t.Errorf("expected output to be equal to mocked one, got %s", o)
+	}
+	if !sets.NewString(fcmd.CombinedOutputLog[0]...).HasAll("nft", "list", "table", "ip6", "kenc") {
+		t.Errorf("wrong CombinedOutput() log, got %s", fcmd.CombinedOutputLog[0])
+	}
+
+	// Failure.
+	_, err = runner.ListTable(FamilyIPv6, "kenc")
+	if err == nil {
+		t.Errorf("expected failure")
+	}
+}
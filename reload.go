@@ -0,0 +1,267 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var (
+	// settingsMu guards the settings applied on reload. Checkpoints are
+	// taken from a snapshot of the settings copied with the read lock held,
+	// so they never see a partial reload and never block it.
+	settingsMu sync.RWMutex
+	// settingsReloaded is closed when the settings are reloaded.
+	settingsReloaded = make(chan struct{})
+
+	// the intervals of the checkpointers
+	checkpointerIntervals map[string]time.Duration
+	// the etcd hosts checkpoint file
+	hostsPath string
+)
+
+// reloadableFlags are the flags whose values are applied on reload. The
+// other flags require a restart.
+var reloadableFlags = map[string]bool{
+	"checkpoint-interval":          true,
+	"checkpoint-intervals":         true,
+	"hosts-dir":                    true,
+	"hosts-file":                   true,
+	"hosts-interval":               true,
+	"hosts-managed-block":          true,
+	"hosts-srv-file":               true,
+	"cluster-domain":               true,
+	"etcd-selector":                true,
+	"iptables-tables":              true,
+	"iptables-services":            true,
+	"kube-proxy-profile":           true,
+	"iptables-chain-patterns":      true,
+	"iptables-chain-patterns-file": true,
+}
+
+// reloadableSettings are the settings derived from the reloadable flags.
+type reloadableSettings struct {
+	checkpointInterval time.Duration
+	intervals          map[string]time.Duration
+	hostsDir           string
+	hostsFile          string
+	hostsPath          string
+	hostsManagedBlock  bool
+	hostsSRVFile       string
+	hostsInterval      time.Duration
+	clusterDomain      string
+	etcdSelector       string
+	iptSelection       iptablesSelection
+}
+
+// newReloadableSettings returns the settings of the given flag values.
+func newReloadableSettings(values map[string]string) (*reloadableSettings, error) {
+	s := &reloadableSettings{
+		hostsDir:      values["hosts-dir"],
+		hostsFile:     values["hosts-file"],
+		hostsPath:     values["hosts-file"],
+		hostsSRVFile:  values["hosts-srv-file"],
+		clusterDomain: values["cluster-domain"],
+		etcdSelector:  values["etcd-selector"],
+	}
+	if len(s.hostsPath) == 0 {
+		s.hostsPath = filepath.Join(s.hostsDir, etcdHostsFilename)
+	}
+	if len(s.clusterDomain) == 0 {
+		return nil, fmt.Errorf("invalid -cluster-domain: must not be empty")
+	}
+
+	if _, err := labels.Parse(s.etcdSelector); err != nil {
+		return nil, fmt.Errorf("invalid -etcd-selector: %v", err)
+	}
+
+	var err error
+	s.checkpointInterval, err = time.ParseDuration(values["checkpoint-interval"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -checkpoint-interval: %v", err)
+	}
+	s.hostsManagedBlock, err = strconv.ParseBool(values["hosts-managed-block"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -hosts-managed-block: %v", err)
+	}
+	s.hostsInterval, err = time.ParseDuration(values["hosts-interval"])
+	if err == nil && s.hostsInterval <= 0 {
+		err = fmt.Errorf("must be positive")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid -hosts-interval: %v", err)
+	}
+	s.intervals, err = parseCheckpointIntervals(values["checkpoint-intervals"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -checkpoint-intervals: %v", err)
+	}
+	s.iptSelection.tables, err = parseIptablesTables(values["iptables-tables"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -iptables-tables: %v", err)
+	}
+	s.iptSelection.services, err = parseServiceSelectors(values["iptables-services"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid -iptables-services: %v", err)
+	}
+	s.iptSelection.patterns, err = loadChainPatterns(values["kube-proxy-profile"], values["iptables-chain-patterns"], values["iptables-chain-patterns-file"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid chain patterns: %v", err)
+	}
+	return s, nil
+}
+
+// apply applies the settings. The caller must hold settingsMu.
+func (s *reloadableSettings) apply() {
+	checkpointInterval = s.checkpointInterval
+	checkpointerIntervals = s.intervals
+	hostsDir = s.hostsDir
+	hostsFile = s.hostsFile
+	hostsPath = s.hostsPath
+	hostsManagedBlock = s.hostsManagedBlock
+	hostsSRVFile = s.hostsSRVFile
+	hostsInterval = s.hostsInterval
+	clusterDomain = s.clusterDomain
+	etcdSelector = s.etcdSelector
+	iptSelection = s.iptSelection
+}
+
+// snapshotSettings returns a copy of the applied settings. The caller must
+// hold settingsMu.
+func snapshotSettings() *reloadableSettings {
+	return &reloadableSettings{
+		checkpointInterval: checkpointInterval,
+		intervals:          checkpointerIntervals,
+		hostsDir:           hostsDir,
+		hostsFile:          hostsFile,
+		hostsPath:          hostsPath,
+		hostsManagedBlock:  hostsManagedBlock,
+		hostsSRVFile:       hostsSRVFile,
+		hostsInterval:      hostsInterval,
+		clusterDomain:      clusterDomain,
+		etcdSelector:       etcdSelector,
+		iptSelection:       iptSelection,
+	}
+}
+
+// flagValues returns the current values of the flags of the given set.
+func flagValues(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// givenFlags returns the names of the flags set on the command line.
+func givenFlags(fs *flag.FlagSet) map[string]bool {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	return given
+}
+
+// reloadConfigFile re-reads the given configuration file and applies the
+// reloadable settings to the running checkpointers. The flags given on the
+// command line keep overriding the file, the settings removed from the file
+// are reset to their defaults. Nothing is applied if the file is invalid.
+func reloadConfigFile(fs *flag.FlagSet, file string, given map[string]bool) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	c, err := parseConfig(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	configured := c.flagValues()
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := configured[f.Name]
+		switch {
+		case given[f.Name]:
+			values[f.Name] = f.Value.String()
+		case ok:
+			values[f.Name] = v
+		default:
+			values[f.Name] = f.DefValue
+		}
+	})
+
+	s, err := newReloadableSettings(values)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	for name, v := range values {
+		f := fs.Lookup(name)
+		if f.Value.String() == v {
+			continue
+		}
+		if !reloadableFlags[name] {
+			log.Printf("-%s changed in %s, restart kenc to apply it", name, file)
+			continue
+		}
+		if err = fs.Set(name, v); err != nil {
+			// validated by newReloadableSettings
+			return fmt.Errorf("%s: -%s: %v", file, name, err)
+		}
+	}
+	s.apply()
+
+	close(settingsReloaded)
+	settingsReloaded = make(chan struct{})
+	return nil
+}
+
+// watchConfigFile reloads the given configuration file on SIGHUP and, if
+// interval is positive, when its modification time changes.
+func watchConfigFile(fs *flag.FlagSet, file string, given map[string]bool, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+	modTime := func() time.Time {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}
+		}
+		return fi.ModTime()
+	}
+	last := modTime()
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			mt := modTime()
+			if mt.Equal(last) {
+				continue
+			}
+			last = mt
+		}
+
+		if err := reloadConfigFile(fs, file, given); err != nil {
+			log.Printf("failed to reload config, keeping the current one: %v", err)
+			continue
+		}
+		log.Printf("reloaded config from %s", file)
+	}
+}
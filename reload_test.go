@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestReloadConfigFile(t *testing.T) {
+	defer snapshotSettings().apply()
+
+	fs := flag.NewFlagSet("kenc", flag.ContinueOnError)
+	fs.Duration("checkpoint-interval", defaultClusterInteval, "")
+	fs.String("checkpoint-intervals", "", "")
+	fs.String("hosts-dir", etcdDir, "")
+	fs.String("hosts-file", "", "")
+	fs.Bool("hosts-managed-block", false, "")
+	fs.String("hosts-srv-file", "", "")
+	fs.Duration("hosts-interval", defaultHostsInterval, "")
+	fs.String("cluster-domain", defaultClusterDomain, "")
+	fs.String("etcd-selector", defaultEtcdSelector, "")
+	fs.String("iptables-tables", "nat", "")
+	fs.String("iptables-services", "", "")
+	fs.String("kube-proxy-profile", defaultChainProfile, "")
+	fs.String("iptables-chain-patterns", "", "")
+	fs.String("iptables-chain-patterns-file", "", "")
+	ip := fs.String("etcd-service-ip", defaultVIP, "")
+	if err := fs.Parse([]string{"-iptables-services", "kube-system/kube-etcd"}); err != nil {
+		t.Fatal(err)
+	}
+	given := givenFlags(fs)
+
+	dir, err := ioutil.TempDir("", "kenc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "kenc.yaml")
+
+	err = ioutil.WriteFile(file, []byte(`version: v1
+checkpointInterval: 1m
+clusterDomain: example.org
+hosts:
+  interval: 30s
+etcdServiceIP: 10.3.0.99
+etcdSelector: component=etcd
+iptables:
+  tables: [nat, filter]
+  services: [default/kubernetes]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := settingsReloaded
+	if err = reloadConfigFile(fs, file, given); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloaded:
+	default:
+		t.Error("expected the checkpointers to be notified")
+	}
+	if checkpointInterval != time.Minute {
+		t.Errorf("got wrong checkpoint interval %v", checkpointInterval)
+	}
+	if hostsInterval != 30*time.Second || clusterDomain != "example.org" {
+		t.Errorf("got wrong hosts settings %v and %s", hostsInterval, clusterDomain)
+	}
+	if etcdSelector != "component=etcd" {
+		t.Errorf("got wrong etcd selector %s", etcdSelector)
+	}
+	if hostsPath != path.Join(etcdDir, etcdHostsFilename) {
+		t.Errorf("got wrong hosts file %s", hostsPath)
+	}
+	if len(iptSelection.tables) != 2 {
+		t.Errorf("got wrong tables %v", iptSelection.tables)
+	}
+	if len(iptSelection.services) != 1 || iptSelection.services[0].String() != "kube-system/kube-etcd" {
+		t.Errorf("expected the command line to override the services, got %v", iptSelection.services)
+	}
+	if *ip != defaultVIP {
+		t.Errorf("expected the etcd service ip to require a restart, got %s", *ip)
+	}
+
+	// an invalid config is not applied
+	err = ioutil.WriteFile(file, []byte("version: v1\ncheckpointInterval: 5s\niptables:\n  tables: [raw]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConfigFile(fs, file, given); err == nil {
+		t.Fatal("expected failure for invalid config")
+	}
+	if checkpointInterval != time.Minute || len(iptSelection.tables) != 2 {
+		t.Error("expected the current settings to be kept")
+	}
+
+	// settings removed from the file are reset to their defaults
+	err = ioutil.WriteFile(file, []byte("version: v1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = reloadConfigFile(fs, file, given); err != nil {
+		t.Fatal(err)
+	}
+	if checkpointInterval != defaultClusterInteval || len(iptSelection.tables) != 1 {
+		t.Errorf("expected the default settings, got %v and %v", checkpointInterval, iptSelection.tables)
+	}
+}